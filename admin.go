@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"craig/data"
+)
+
+// ResetConversation makes the agent forget a conversation.
+func (app *App) ResetConversation(conversationID string, requestedBy string) error {
+	err := app.sessions.Reset(conversationID, fmt.Sprintf("%s asked for a reset", requestedBy))
+	if err != nil {
+		return err
+	}
+	app.logger.Info("Reset conversation", "conversation", conversationID, "by", requestedBy)
+	return nil
+}
+
+// ConversationStatus describes the agent's session for a conversation.
+func (app *App) ConversationStatus(conversationID string) (string, error) {
+	status, total := app.sessions.Status(conversationID)
+	lines := []string{fmt.Sprintf("Active conversations: %d", total)}
+	switch {
+	case !status.Loaded:
+		lines = append(lines, "This conversation is not active (it will be picked up from its transcript when someone next talks to me)")
+	case status.Busy:
+		lines = append(lines, "I am currently working on a message in this conversation")
+	default:
+		lines = append(lines,
+			fmt.Sprintf("Messages since the last reset: %d", status.Turns),
+			fmt.Sprintf("Started: %s", status.StartedAt.Format(time.RFC1123)),
+			fmt.Sprintf("Last active: %s", status.LastActive.Format(time.RFC1123)),
+			fmt.Sprintf("History since the last summary: ~%d tokens", status.ApproxTokens),
+		)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// ScratchPad returns the current content of the agent's scratchpad.
+func (app *App) ScratchPad() (string, error) {
+	content, err := app.data.GetScratchPad().Content()
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(content) == "" {
+		return "The scratchpad is empty", nil
+	}
+	return content, nil
+}
+
+// SkillList lists the agent's skills and when they are used.
+func (app *App) SkillList() (string, error) {
+	skills, err := app.data.GetSkillset().List()
+	if err != nil {
+		return "", err
+	}
+	if len(skills) == 0 {
+		return "There are no skills", nil
+	}
+	lines := make([]string, len(skills))
+	for i, skill := range skills {
+		when := skill.When
+		if when == "" {
+			when = "always"
+		}
+		lines[i] = fmt.Sprintf("- **%s**: %s", skill.Key, when)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// ModelInfo describes the models the agent uses.
+func (app *App) ModelInfo() (string, error) {
+	agent, err := app.data.AgentModel()
+	if err != nil {
+		return "", err
+	}
+	filter, err := app.data.FilterModel()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Agent model: %s\nFilter model: %s", describeModel(agent), describeModel(filter)), nil
+}
+
+func describeModel(setup data.ModelSetup) string {
+	desc := fmt.Sprintf("`%s` (%s)", setup.Name, setup.Provider)
+	if setup.ReasoningEffort != nil {
+		desc += fmt.Sprintf(", reasoning effort %s", *setup.ReasoningEffort)
+	}
+	if setup.Temperature != nil {
+		desc += fmt.Sprintf(", temperature %.2f", *setup.Temperature)
+	}
+	return desc
+}
+
+// MCPServerList lists the configured MCP servers.
+func (app *App) MCPServerList() (string, error) {
+	servers, err := app.data.MCPServers()
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "There are no MCP servers", nil
+	}
+	lines := make([]string, len(servers))
+	for i, server := range servers {
+		state := "enabled"
+		if !server.Enabled {
+			state = "disabled"
+		}
+		lines[i] = fmt.Sprintf("- **%s** (%s): %s", server.Name, state, redactServerURL(server.URL))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// redactServerURL cuts a server's URL down to its scheme and host, as the rest of it (the user info, path or query) can hold credentials.
+func redactServerURL(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return "(unrecognised URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -2,20 +2,28 @@ package ai
 
 import (
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
 	"craig/ai/tools"
 	"craig/data"
 
+	"github.com/JoshPattman/jpf"
 	"github.com/JoshPattman/react"
 )
 
-func NewAgentBuilder(modelBuilder react.ModelBuilder, pad data.ScratchPad, skillset data.Skillset, personality data.Personality, tools data.Tools) *AgentBuilder {
+// NewAgentBuilder creates an agent builder. The configured tools (such as MCP tools) are shared by every agent it builds.
+func NewAgentBuilder(modelBuilder react.ModelBuilder, pad data.ScratchPad, skillset data.Skillset, personality data.Personality, tools []react.Tool, transcripts data.Transcripts, permissions data.ToolPermissions) *AgentBuilder {
 	return &AgentBuilder{
 		modelBuilder: modelBuilder,
 		pad:          pad,
 		skillset:     skillset,
 		personality:  personality,
 		tools:        tools,
+		transcripts:  transcripts,
+		permissions:  permissions,
 	}
 }
 
@@ -24,34 +32,97 @@ type AgentBuilder struct {
 	pad          data.ScratchPad
 	skillset     data.Skillset
 	personality  data.Personality
-	tools        data.Tools
+	tools        []react.Tool
+	transcripts  data.Transcripts
+	permissions  data.ToolPermissions
 }
 
-func (ab *AgentBuilder) BuildNew() (*AgentRuntime, error) {
-	skills, err := ab.skillset.List()
+// BuildNew creates an agent for a conversation.
+// If the conversation already has a transcript, the agent will be told about it so it can carry on where it left off.
+func (ab *AgentBuilder) BuildNew(conversationID string) (*AgentRuntime, error) {
+	transcript, err := ab.transcripts.Load(conversationID)
 	if err != nil {
 		return nil, err
 	}
-	personality, err := ab.personality.Personality()
+	transcript = sinceLastReset(transcript)
+	imageCount := 0
+	for _, entry := range transcript {
+		// Carry on numbering images from where the transcript left off (including retracted messages), so their markers stay unique.
+		imageCount += strings.Count(entry.Content, imageMarkerPrefix)
+	}
+	transcript = withoutRetracted(transcript)
+	startedAt := time.Now()
+	if len(transcript) > 0 {
+		startedAt = transcript[0].Time
+	}
+	turns := 0
+	for _, entry := range transcript {
+		switch {
+		case entry.Kind == data.TranscriptUserMessage:
+			turns++
+		case entry.Kind == data.TranscriptSummary && entry.Turns > 0:
+			// The entries before a summary are replaced by it, so it records what was worked out from them.
+			turns = entry.Turns
+			startedAt = entry.StartedAt
+		}
+	}
+	summary, transcript := latestSummary(transcript)
+	if len(transcript) > maxRestoredTranscriptEntries {
+		transcript = transcript[len(transcript)-maxRestoredTranscriptEntries:]
+	}
+
+	runtime := &AgentRuntime{
+		builder:     ab,
+		recorder:    &transcriptRecorder{transcripts: ab.transcripts, conversationID: conversationID, pending: slices.Clone(transcript)},
+		summary:     summary,
+		restored:    transcript,
+		startedAt:   startedAt,
+		turns:       turns,
+		lastContext: make(map[string]string),
+		imageCount:  imageCount,
+	}
+	for _, entry := range transcript {
+		if entry.Kind == data.TranscriptUserMessage {
+			runtime.lastUserName = entry.Author
+			runtime.lastLocation = entry.Location
+			// The transcript does not say who sent the message, so they may not have been permitted to rewrite the scratchpad.
+			runtime.scratchpadDenied = true
+		}
+	}
+	runtime.agent, err = ab.buildAgent(runtime)
 	if err != nil {
 		return nil, err
 	}
+	return runtime, nil
+}
 
-	confTools, err := ab.tools.EnabledTools()
+func (ab *AgentBuilder) buildAgent(runtime *AgentRuntime) (*react.Agent, error) {
+	skills, err := ab.skillset.List()
+	if err != nil {
+		return nil, err
+	}
+	personality, err := ab.personality.Personality()
 	if err != nil {
 		return nil, err
 	}
 
-	agent := react.New(
-		ab.modelBuilder,
-		react.WithTools(tools.NewTimeTool(), tools.NewReadScratchPadTool(ab.pad), tools.NewRewriteScratchPadTool(ab.pad)),
-		react.WithTools(confTools...),
+	runtime.tools = []react.Tool{
+		tools.NewTimeTool(),
+		tools.NewReadScratchPadTool(ab.pad),
+		tools.NewRewriteScratchPadTool(ab.pad),
+		tools.NewReadAttachmentTool(runtime),
+		tools.NewAttachFileTool(runtime),
+		tools.NewAddEmbedTool(runtime),
+	}
+	runtime.tools = append(runtime.tools, tools.NewChannelTools(runtime)...)
+	runtime.tools = append(runtime.tools, tools.NewReadChannelHistoryTool(runtime))
+	runtime.tools = append(runtime.tools, ab.tools...)
+	return react.New(
+		&streamingModelBuilder{ab.modelBuilder, runtime},
+		react.WithTools(runtime.wrapTools(runtime.tools)...),
 		react.WithSkills(skills...),
 		react.WithPersonality(personality),
-	)
-	return &AgentRuntime{
-		agent: agent,
-	}, nil
+	), nil
 }
 
 type AgentRuntime struct {
@@ -59,10 +130,84 @@ type AgentRuntime struct {
 	lastLocation string
 	agent        *react.Agent
 	hasInit      bool
+	stream       Stream
+	builder      *AgentBuilder
+	recorder     *transcriptRecorder
+	// The summary of the conversation before the current agent was built.
+	summary string
+	// Entries from before the current agent was built that it has not yet been told about.
+	restored []data.TranscriptEntry
+	// Whether the current agent has been told about the summary and restored entries.
+	hasCarriedOver bool
+	// When the conversation started, and how many messages have been sent in it, since it was last reset.
+	startedAt time.Time
+	turns     int
+	// The content of the last context of each kind that was shown to the agent.
+	lastContext map[string]string
+	// All tools the agent has, and the names of the ones the current sender is not permitted to use.
+	tools       []react.Tool
+	deniedTools []string
+	// Images attached to recent messages, which are shown to the agent, and the number of images that have been attached so far.
+	images     []attachedImage
+	imageCount int
+	// Large files attached to messages, which the agent can read with the read_attachment tool.
+	attachments []storedAttachment
+	// The files and embeds the agent has attached to the reply it is working on.
+	reply Reply
+	// The actions available in the channel of the message the agent is replying to.
+	actions tools.ChannelActions
+	// Whether anyone who has sent a message since the history was last summarised may not be permitted to rewrite the scratchpad,
+	// in which case facts from the summary are not written to it, so that they cannot be used to get around the permission.
+	scratchpadDenied bool
+}
+
+// Stream receives the progress of the agent, and its final response while it is being generated.
+// Any function may be nil.
+type Stream struct {
+	// Called when the final response begins, may be called multiple times if retries occur.
+	OnBegin func()
+	// Called when a new chunk of the final response is received.
+	OnText func(string)
+	// Called with the name of a tool just before the agent calls it.
+	OnToolCall func(string)
+}
+
+// Message is a message from a user to the agent.
+type Message struct {
+	// The ids of the message on its frontend (several if it combines messages), which are used to remove it from the conversation if one of them is edited or deleted. May be empty.
+	IDs      []string
+	Content  string
+	UserName string
+	Location string
+	// Used to decide which tools the sender is permitted to use.
+	UserID    string
+	UserRoles []string
+	// Extra information that is shown to the agent alongside the message.
+	Context []MessageContext
+	Images  []Image
+	Files   []File
+	// Actions that the agent can perform in the channel the message was sent in, or nil if there are none.
+	Actions tools.ChannelActions
+}
+
+// MessageContext is a piece of extra information about a message, which is shown to the agent as a notification.
+type MessageContext struct {
+	Kind    string
+	Content string
+	// If set, the context is only shown when it differs from the last context of the same kind that was shown.
+	OnlyOnChange bool
 }
 
-func (r *AgentRuntime) Send(msg string, userName string, location string) (string, error) {
+func (r *AgentRuntime) Send(msg Message, stream Stream) (Reply, error) {
+	r.stream = stream
+	r.reply = Reply{}
+	r.actions = msg.Actions
+	defer func() { r.stream, r.reply, r.actions = Stream{}, Reply{}, nil }()
+	r.turns++
+	msg = r.attachImages(msg)
+	msg = r.attachFiles(msg)
 	notifications := []react.NotificationMessage{}
+	userName, location := msg.UserName, msg.Location
 	if userName != r.lastUserName {
 		notifications = append(notifications, react.NotificationMessage{
 			Kind:    "switch_user",
@@ -84,5 +229,166 @@ func (r *AgentRuntime) Send(msg string, userName string, location string) (strin
 			Content: "Remember to check your scratchpad immediately before anything else (only required on this first message)",
 		})
 	}
-	return r.agent.Send(msg, react.WithNotifications(notifications...))
+
+	r.deniedTools = deniedTools(r.builder.permissions, msg, r.tools)
+	if slices.Contains(r.deniedTools, rewriteScratchPadTool) {
+		r.scratchpadDenied = true
+	}
+	if len(r.deniedTools) > 0 || r.lastContext["tool_permissions"] != "" {
+		content := "The user talking to you is permitted to use all of your tools."
+		if len(r.deniedTools) > 0 {
+			content = fmt.Sprintf("The user talking to you is not permitted to use these tools, so do not try to use them on their behalf: %s", strings.Join(r.deniedTools, ", "))
+		}
+		msg.Context = append(msg.Context, MessageContext{Kind: "tool_permissions", Content: content, OnlyOnChange: true})
+	}
+
+	for _, c := range msg.Context {
+		if c.OnlyOnChange {
+			if r.lastContext[c.Kind] == c.Content {
+				continue
+			}
+			r.lastContext[c.Kind] = c.Content
+		}
+		notifications = append(notifications, react.NotificationMessage{Kind: c.Kind, Content: c.Content})
+	}
+
+	entries := []data.TranscriptEntry{{Kind: data.TranscriptUserMessage, Author: userName, Location: location, Content: msg.Content, MessageIDs: msg.IDs}}
+	for _, n := range notifications {
+		entries = append(entries, data.TranscriptEntry{Kind: data.TranscriptNotification, Content: n.Content})
+	}
+	err := r.recorder.record(entries...)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	if !r.hasCarriedOver {
+		r.hasCarriedOver = true
+		if carryOver, ok := r.carryOverNotification(); ok {
+			notifications = append([]react.NotificationMessage{carryOver}, notifications...)
+		}
+		r.restored = nil
+	}
+
+	response, err := r.agent.Send(msg.Content, react.WithNotifications(notifications...))
+	if err != nil {
+		return Reply{}, err
+	}
+	reply := r.reply
+	reply.Text = response
+	err = r.recorder.record(data.TranscriptEntry{Kind: data.TranscriptReply, Content: reply.transcriptContent()})
+	if err != nil {
+		// The reply has already been generated, so it is better to send it than to fail.
+		slog.Warn("Failed to record reply", "conversation", r.recorder.conversationID, "err", err.Error())
+	}
+	return reply, nil
+}
+
+// Retract removes a message, and everything that happened in reply to it, from the conversation.
+// The agent is replaced with a fresh one which is told the rest of the conversation, so it forgets the message completely.
+// It returns false if the message is not in the conversation (for example, because it has already been summarised).
+func (r *AgentRuntime) Retract(messageID string) (bool, error) {
+	remaining, ok := removeMessage(r.recorder.pendingEntries(), messageID)
+	if !ok {
+		return false, nil
+	}
+	err := r.recorder.recordRetraction(messageID, remaining)
+	if err != nil {
+		return false, err
+	}
+	if len(remaining) > maxRestoredTranscriptEntries {
+		remaining = remaining[len(remaining)-maxRestoredTranscriptEntries:]
+	}
+	err = r.rebuildAgent(remaining)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rebuildAgent replaces the agent with a fresh one, which is told the summary and the restored entries on the next message.
+func (r *AgentRuntime) rebuildAgent(restored []data.TranscriptEntry) error {
+	agent, err := r.builder.buildAgent(r)
+	if err != nil {
+		return err
+	}
+	r.agent = agent
+	r.restored = restored
+	// The new agent knows nothing, so tell it everything again on the next message.
+	r.hasCarriedOver = false
+	r.hasInit = false
+	r.lastUserName = ""
+	r.lastLocation = ""
+	r.lastContext = make(map[string]string)
+	return nil
+}
+
+func (r *AgentRuntime) ChannelActions() tools.ChannelActions {
+	return r.actions
+}
+
+func (r *AgentRuntime) carryOverNotification() (react.NotificationMessage, bool) {
+	if r.summary == "" && len(r.restored) == 0 {
+		return react.NotificationMessage{}, false
+	}
+	content := "You do not remember the start of this conversation, as your memory of it has been compacted, a message has been removed from it, or you have been restarted."
+	if r.summary != "" {
+		content += "\nHere is a summary of the conversation so far:\n" + r.summary
+	}
+	if len(r.restored) > 0 {
+		content += "\nHere is a transcript of the most recent part of the conversation:\n" + formatTranscript(r.restored)
+	}
+	return react.NotificationMessage{Kind: "conversation_history", Content: content}, true
+}
+
+// wrapTools wraps tools so that they can only be called by permitted senders, and calls to them are recorded in the transcript and reported to the stream.
+func (r *AgentRuntime) wrapTools(tools []react.Tool) []react.Tool {
+	wrapped := make([]react.Tool, len(tools))
+	for i, tool := range tools {
+		wrapped[i] = &permissionTool{&reportingTool{&recordingTool{tool, r.recorder}, r}, r}
+	}
+	return wrapped
+}
+
+// reportingTool tells the stream of the runtime whenever the wrapped tool is called.
+type reportingTool struct {
+	react.Tool
+	runtime *AgentRuntime
+}
+
+func (t *reportingTool) Call(args map[string]any) (string, error) {
+	if t.runtime.stream.OnToolCall != nil {
+		t.runtime.stream.OnToolCall(t.Tool.Name())
+	}
+	return t.Tool.Call(args)
+}
+
+// streamingModelBuilder forwards the final response stream of agent models to whichever stream the runtime is currently sending with, and shows agent models the images attached to recent messages.
+type streamingModelBuilder struct {
+	react.ModelBuilder
+	runtime *AgentRuntime
+}
+
+func (m *streamingModelBuilder) BuildAgentModel(responseType any, onInitFinalStream func(), onDataFinalStream func(string)) jpf.Model {
+	if onDataFinalStream == nil {
+		// Not a final response model, so there is nothing to forward.
+		return &imageModel{m.ModelBuilder.BuildAgentModel(responseType, onInitFinalStream, onDataFinalStream), m.runtime}
+	}
+	model := m.ModelBuilder.BuildAgentModel(
+		responseType,
+		func() {
+			if onInitFinalStream != nil {
+				onInitFinalStream()
+			}
+			if m.runtime.stream.OnBegin != nil {
+				m.runtime.stream.OnBegin()
+			}
+		},
+		func(text string) {
+			onDataFinalStream(text)
+			if m.runtime.stream.OnText != nil {
+				m.runtime.stream.OnText(text)
+			}
+		},
+	)
+	return &imageModel{model, m.runtime}
 }
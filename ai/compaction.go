@@ -0,0 +1,117 @@
+package ai
+
+import (
+	"context"
+	"craig/data"
+	"errors"
+	"strings"
+
+	"github.com/JoshPattman/jpf"
+)
+
+type compactionResult struct {
+	Summary      string   `json:"summary" jsonschema_description:"A summary of the conversation, detailed enough to carry on the conversation from"`
+	DurableFacts []string `json:"durable_facts" jsonschema_description:"Facts that are worth remembering long after this conversation has ended (may be empty)"`
+}
+
+const compactionPrompt = `You are summarising a conversation between an AI assistant and one or more users, so that the assistant can carry on the conversation without the full history.
+You will be given the previous summary (if there is one) followed by a transcript of the conversation since then.
+Write a single summary which covers both, keeping anything the assistant would need to carry on naturally: who said what, open questions, decisions, and what the assistant has promised to do.
+Also list any durable facts that are worth remembering long after this conversation ends (for example, a user's preferences), but only if they are genuinely useful.
+Respond with a JSON object.`
+
+// approxTokens estimates the number of tokens in transcript entries.
+func approxTokens(entries []data.TranscriptEntry) int {
+	n := 0
+	for _, entry := range entries {
+		n += (len(entry.Content) + len(entry.Author) + len(entry.Location)) / 4
+	}
+	return n
+}
+
+// NeedsCompaction checks whether the history since the last compaction exceeds the policy.
+func (r *AgentRuntime) NeedsCompaction(policy data.CompactionPolicy) bool {
+	pending := r.recorder.pendingEntries()
+	if policy.MaxMessages > 0 {
+		messages := 0
+		for _, entry := range pending {
+			if entry.Kind == data.TranscriptUserMessage {
+				messages++
+			}
+		}
+		if messages >= policy.MaxMessages {
+			return true
+		}
+	}
+	return policy.MaxTokens > 0 && approxTokens(pending) >= policy.MaxTokens
+}
+
+// Compact summarises the history since the last compaction, then replaces the agent with a fresh one which is told the summary.
+func (r *AgentRuntime) Compact(policy data.CompactionPolicy) error {
+	summarised, err := r.summariseHistory(policy)
+	if err != nil || !summarised {
+		return err
+	}
+	return r.rebuildAgent(nil)
+}
+
+// summariseHistory records a summary of the history since the last compaction in the transcript, without replacing the agent.
+func (r *AgentRuntime) summariseHistory(policy data.CompactionPolicy) (bool, error) {
+	pending := r.recorder.pendingEntries()
+	if len(pending) == 0 {
+		return false, nil
+	}
+	result, err := r.builder.summarise(r.summary, pending)
+	if err != nil {
+		return false, err
+	}
+	if policy.WriteFacts && !r.scratchpadDenied && len(result.DurableFacts) > 0 {
+		err = appendToScratchPad(r.builder.pad, result.DurableFacts)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = r.recorder.recordSummary(result.Summary, r.turns, r.startedAt)
+	if err != nil {
+		return false, err
+	}
+	r.summary = result.Summary
+	r.scratchpadDenied = false
+	return true, nil
+}
+
+func (ab *AgentBuilder) summarise(previousSummary string, entries []data.TranscriptEntry) (compactionResult, error) {
+	input := "Previous summary:\n"
+	if previousSummary == "" {
+		input += "(none)"
+	} else {
+		input += previousSummary
+	}
+	input += "\n\nTranscript:\n" + formatTranscript(entries)
+	pipeline := jpf.NewOneShotPipeline(
+		jpf.NewFixedEncoder(compactionPrompt),
+		jpf.NewJsonParser[compactionResult](),
+		nil,
+		ab.modelBuilder.BuildFragmentSelectorModel(compactionResult{}),
+	)
+	result, _, err := pipeline.Call(context.Background(), input)
+	if err != nil {
+		return compactionResult{}, err
+	}
+	if result.Summary == "" {
+		return compactionResult{}, errors.New("summary was empty")
+	}
+	return result, nil
+}
+
+func appendToScratchPad(pad data.ScratchPad, facts []string) error {
+	content, err := pad.Content()
+	if err != nil {
+		return err
+	}
+	addition := "- " + strings.Join(facts, "\n- ")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		addition = "\n" + addition
+	}
+	return pad.Rewrite(content, content+addition)
+}
@@ -0,0 +1,70 @@
+package ai
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Attached files up to this many characters are shown in full in the message, larger files must be read with the read_attachment tool.
+const maxInlineFileChars = 6000
+
+// Only this many of the most recent large attachments are kept for the read_attachment tool.
+const maxStoredAttachments = 10
+
+// File is a text file (or the text extracted from a document) attached to a message.
+type File struct {
+	Name    string
+	Content string
+}
+
+type storedAttachment struct {
+	name    string
+	content string
+}
+
+// attachFiles adds small files to the content of a message, and stores large files so that the agent can read them with the read_attachment tool.
+func (r *AgentRuntime) attachFiles(msg Message) Message {
+	for _, file := range msg.Files {
+		if len(file.Content) <= maxInlineFileChars {
+			msg.Content = strings.TrimSpace(fmt.Sprintf("%s\n[Attached file: %s]\n```\n%s\n```", msg.Content, file.Name, file.Content))
+			continue
+		}
+		name := r.storeAttachment(file)
+		msg.Content = strings.TrimSpace(fmt.Sprintf(
+			"%s\n[Attached file: %s (%d lines), this is too large to show here, use the read_attachment tool to read it]",
+			msg.Content, name, strings.Count(file.Content, "\n")+1,
+		))
+	}
+	return msg
+}
+
+// storeAttachment stores a file for the read_attachment tool, returning the name it was stored under.
+func (r *AgentRuntime) storeAttachment(file File) string {
+	name := file.Name
+	for i := 2; slices.ContainsFunc(r.attachments, func(a storedAttachment) bool { return a.name == name }); i++ {
+		name = fmt.Sprintf("%s (%d)", file.Name, i)
+	}
+	r.attachments = append(r.attachments, storedAttachment{name, file.Content})
+	if len(r.attachments) > maxStoredAttachments {
+		r.attachments = r.attachments[len(r.attachments)-maxStoredAttachments:]
+	}
+	return name
+}
+
+func (r *AgentRuntime) Attachment(name string) (string, bool) {
+	for _, attachment := range r.attachments {
+		if attachment.name == name {
+			return attachment.content, true
+		}
+	}
+	return "", false
+}
+
+func (r *AgentRuntime) AttachmentNames() []string {
+	names := make([]string, len(r.attachments))
+	for i, attachment := range r.attachments {
+		names[i] = attachment.name
+	}
+	return names
+}
@@ -0,0 +1,48 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/JoshPattman/jpf"
+	"github.com/JoshPattman/react"
+)
+
+func NewReplyFilter(modelBuilder react.ModelBuilder) *ReplyFilter {
+	return &ReplyFilter{modelBuilder: modelBuilder}
+}
+
+// ReplyFilter uses the cheap filter model to decide whether a message is worth running the agent for.
+type ReplyFilter struct {
+	modelBuilder react.ModelBuilder
+}
+
+type replyFilterResult struct {
+	Reasoning   string `json:"reasoning" jsonschema_description:"A short explanation of the decision"`
+	ShouldReply bool   `json:"should_reply" jsonschema_description:"Whether the assistant should consider replying to the message"`
+}
+
+const replyFilterPrompt = `You are deciding whether an AI assistant called Craig should consider replying to a message in a group chat.
+Craig should consider replying if the message is directed at Craig, continues a conversation that Craig is part of, or asks something that Craig could clearly help with and nobody else is being asked.
+Craig should not reply to messages that are clearly part of a conversation between other people.
+If in doubt, say that Craig should consider replying.
+Respond with a JSON object.`
+
+// ShouldReply decides whether the agent should consider replying to a message.
+func (f *ReplyFilter) ShouldReply(msg Message) (bool, error) {
+	input := fmt.Sprintf("Location: %s\nFrom: %s\nMessage: %s", msg.Location, msg.UserName, msg.Content)
+	for _, c := range msg.Context {
+		input += fmt.Sprintf("\n%s: %s", c.Kind, c.Content)
+	}
+	pipeline := jpf.NewOneShotPipeline(
+		jpf.NewFixedEncoder(replyFilterPrompt),
+		jpf.NewJsonParser[replyFilterResult](),
+		nil,
+		f.modelBuilder.BuildFragmentSelectorModel(replyFilterResult{}),
+	)
+	result, _, err := pipeline.Call(context.Background(), input)
+	if err != nil {
+		return false, err
+	}
+	return result.ShouldReply, nil
+}
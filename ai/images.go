@@ -0,0 +1,93 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+
+	"github.com/JoshPattman/jpf"
+)
+
+// Images are only shown to the agent for this many messages after they were sent, as they are expensive to send with every request.
+const imageMemoryTurns = 3
+
+// The marker that is added to the content of a message for each image attached to it.
+const imageMarkerPrefix = "[Attached image #"
+
+// Image is an image attached to a message.
+type Image struct {
+	Name   string
+	Source image.Image
+}
+
+type attachedImage struct {
+	marker string
+	source image.Image
+	turn   int
+}
+
+// ImageSupporter is implemented by model builders that know whether their agent model can see images.
+type ImageSupporter interface {
+	AgentSupportsImages() bool
+}
+
+func (ab *AgentBuilder) agentSupportsImages() bool {
+	supporter, ok := ab.modelBuilder.(ImageSupporter)
+	return !ok || supporter.AgentSupportsImages()
+}
+
+// attachImages adds a marker for each image to the content of a message, and remembers the images so that they can be shown to the agent alongside the message.
+// If the agent cannot see images, a notification saying so is added to the message instead.
+func (r *AgentRuntime) attachImages(msg Message) Message {
+	r.images = slices.DeleteFunc(r.images, func(img attachedImage) bool {
+		return r.turns-img.turn >= imageMemoryTurns
+	})
+	if len(msg.Images) == 0 {
+		return msg
+	}
+	names := make([]string, len(msg.Images))
+	for i, img := range msg.Images {
+		names[i] = img.Name
+	}
+	if !r.builder.agentSupportsImages() {
+		msg.Content = strings.TrimSpace(fmt.Sprintf("%s\n[Attached images: %s]", msg.Content, strings.Join(names, ", ")))
+		msg.Context = append(msg.Context, MessageContext{
+			Kind:    "attachments",
+			Content: "The user attached images to their message, but you are not able to see images. If the images seem important, tell the user that you cannot see them.",
+		})
+		return msg
+	}
+	for i, img := range msg.Images {
+		r.imageCount++
+		marker := fmt.Sprintf("%s%d: %s]", imageMarkerPrefix, r.imageCount, names[i])
+		msg.Content = strings.TrimSpace(msg.Content + "\n" + marker)
+		r.images = append(r.images, attachedImage{marker, img.Source, r.turns})
+	}
+	return msg
+}
+
+// imageModel shows the agent the images attached to recent messages, by adding them to the model messages that contain their markers.
+type imageModel struct {
+	jpf.Model
+	runtime *AgentRuntime
+}
+
+func (m *imageModel) Respond(ctx context.Context, msgs []jpf.Message) (jpf.ModelResponse, error) {
+	if len(m.runtime.images) == 0 {
+		return m.Model.Respond(ctx, msgs)
+	}
+	msgs = slices.Clone(msgs)
+	for i, msg := range msgs {
+		if msg.Role == jpf.AssistantRole || msg.Role == jpf.ReasoningRole {
+			continue
+		}
+		for _, img := range m.runtime.images {
+			if strings.Contains(msg.Content, img.marker) {
+				msgs[i].Images = append(slices.Clone(msgs[i].Images), jpf.ImageAttachment{Source: img.source})
+			}
+		}
+	}
+	return m.Model.Respond(ctx, msgs)
+}
@@ -25,6 +25,10 @@ type simpleAgentModelBuilder struct {
 	geminiKey   string
 }
 
+func (m *simpleAgentModelBuilder) AgentSupportsImages() bool {
+	return m.agentSetup.Images == nil || *m.agentSetup.Images
+}
+
 func (m *simpleAgentModelBuilder) BuildFragmentSelectorModel(responseType any) jpf.Model {
 	model, err := buildModel(m.filterSetup, m.openAIKey, m.geminiKey, responseType, nil, nil)
 	if err != nil {
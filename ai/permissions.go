@@ -0,0 +1,92 @@
+package ai
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"craig/data"
+
+	"github.com/JoshPattman/react"
+)
+
+// The name of the tool that rewrites the scratchpad. Compaction only writes to the scratchpad if everyone in the conversation is permitted to use it.
+const rewriteScratchPadTool = "rewrite_scratchpad"
+
+// deniedTools lists the names of the tools that the sender of a message is not permitted to use.
+// The sender's own rule takes priority, then the rules of their roles, then the default rule.
+// Tools that no rule mentions are not permitted.
+func deniedTools(permissions data.ToolPermissions, msg Message, tools []react.Tool) []string {
+	denied := make([]string, 0)
+	for _, tool := range tools {
+		if !toolPermitted(permissions, msg, tool) {
+			denied = append(denied, tool.Name())
+		}
+	}
+	return denied
+}
+
+func toolPermitted(permissions data.ToolPermissions, msg Message, tool react.Tool) bool {
+	if rule, ok := permissions.Users[msg.UserID]; ok {
+		if allowed, mentioned := ruleDecision(rule, tool); mentioned {
+			return allowed
+		}
+	}
+	anyRoleAllows := false
+	for _, role := range msg.UserRoles {
+		rule, ok := permissions.Roles[role]
+		if !ok {
+			continue
+		}
+		allowed, mentioned := ruleDecision(rule, tool)
+		if mentioned && !allowed {
+			// A deny from any role wins over an allow from another.
+			return false
+		}
+		anyRoleAllows = anyRoleAllows || allowed
+	}
+	if anyRoleAllows {
+		return true
+	}
+	allowed, _ := ruleDecision(permissions.Default, tool)
+	return allowed
+}
+
+// ruleDecision checks whether a rule allows a tool, and whether the rule mentions the tool at all.
+// Denies take priority over allows.
+func ruleDecision(rule data.ToolRule, tool react.Tool) (allowed bool, mentioned bool) {
+	matches := func(pattern string) bool {
+		return toolMatches(pattern, tool)
+	}
+	if slices.ContainsFunc(rule.Deny, matches) {
+		return false, true
+	}
+	if slices.ContainsFunc(rule.Allow, matches) {
+		return true, true
+	}
+	return false, false
+}
+
+func toolMatches(pattern string, tool react.Tool) bool {
+	if pattern == "*" || pattern == tool.Name() {
+		return true
+	}
+	if server, ok := strings.CutPrefix(pattern, "mcp:"); ok {
+		mcpTool, isMCP := tool.(data.MCPTool)
+		return isMCP && mcpTool.Server() == server
+	}
+	return false
+}
+
+// permissionTool refuses calls from senders that are not permitted to use the wrapped tool.
+type permissionTool struct {
+	react.Tool
+	runtime *AgentRuntime
+}
+
+func (t *permissionTool) Call(args map[string]any) (string, error) {
+	if slices.Contains(t.runtime.deniedTools, t.Tool.Name()) {
+		return "", fmt.Errorf("%s is not permitted to use %s", t.runtime.lastUserName, t.Tool.Name())
+	}
+	return t.Tool.Call(args)
+}
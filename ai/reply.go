@@ -0,0 +1,60 @@
+package ai
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"craig/ai/tools"
+)
+
+// Only this many files and embeds can be sent with a single reply.
+const (
+	maxReplyFiles  = 10
+	maxReplyEmbeds = 10
+)
+
+// Reply is the agent's reply to a message, including any files and embeds it attached with tools.
+type Reply struct {
+	Text   string
+	Files  []tools.ReplyFile
+	Embeds []tools.ReplyEmbed
+}
+
+// IsEmpty checks whether there is nothing to send, which happens when the agent chooses not to reply.
+func (r Reply) IsEmpty() bool {
+	return r.Text == "" && len(r.Files) == 0 && len(r.Embeds) == 0
+}
+
+// transcriptContent describes the reply for the transcript, listing attachments rather than including them.
+func (r Reply) transcriptContent() string {
+	lines := []string{r.Text}
+	for _, file := range r.Files {
+		lines = append(lines, fmt.Sprintf("[Attached file: %s]", file.Name))
+	}
+	for _, embed := range r.Embeds {
+		lines = append(lines, fmt.Sprintf("[Embed: %s]", embed.Title))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func (r *AgentRuntime) AttachFile(file tools.ReplyFile) error {
+	if len(r.reply.Files) >= maxReplyFiles {
+		return fmt.Errorf("at most %d files can be attached to a reply", maxReplyFiles)
+	}
+	for _, existing := range r.reply.Files {
+		if existing.Name == file.Name {
+			return errors.New("a file with that name is already attached to the reply")
+		}
+	}
+	r.reply.Files = append(r.reply.Files, file)
+	return nil
+}
+
+func (r *AgentRuntime) AddEmbed(embed tools.ReplyEmbed) error {
+	if len(r.reply.Embeds) >= maxReplyEmbeds {
+		return fmt.Errorf("at most %d embeds can be added to a reply", maxReplyEmbeds)
+	}
+	r.reply.Embeds = append(r.reply.Embeds, embed)
+	return nil
+}
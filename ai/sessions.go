@@ -0,0 +1,339 @@
+package ai
+
+import (
+	"craig/data"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+func NewSessionManager(builder *AgentBuilder, policy data.SessionPolicy) *SessionManager {
+	return &SessionManager{
+		builder:  builder,
+		policy:   policy,
+		sessions: make(map[string]*Session),
+		held:     make(map[string]chan struct{}),
+	}
+}
+
+// errSessionClosed is returned when a message is sent to a session that was removed (for example, because it was reset) while the message waited for it.
+// The message should be sent again to the conversation's new session.
+var errSessionClosed = errors.New("the session was closed")
+
+// SessionManager keeps a separate agent session for each conversation, so that conversations do not share history and can run concurrently.
+type SessionManager struct {
+	builder  *AgentBuilder
+	policy   data.SessionPolicy
+	lock     sync.Mutex
+	sessions map[string]*Session
+	// Conversations whose transcripts are being built from or rewritten outside of a session, which are closed once that is done.
+	// Sessions for them are not created or handed out in the meantime, so that none can be built from a transcript that is about to change.
+	held map[string]chan struct{}
+}
+
+// Session is a single conversation with its own agent.
+// Messages within a session are sent one at a time.
+type Session struct {
+	id           string
+	lock         sync.Mutex
+	builder      *AgentBuilder
+	runtime      *AgentRuntime
+	lastActive   time.Time
+	lastLocation string
+	policy       data.SessionPolicy
+	// Set once the session has been removed from its manager, after which no more messages are sent to it.
+	closed bool
+}
+
+// Get returns the session for a conversation, creating it if it does not exist.
+func (m *SessionManager) Get(id string) (*Session, error) {
+	m.lock.Lock()
+	_, held := m.held[id]
+	session, ok := m.sessions[id]
+	m.lock.Unlock()
+	if ok && !held {
+		return session, nil
+	}
+	release := m.hold(id)
+	defer release()
+	m.lock.Lock()
+	session, ok = m.sessions[id]
+	m.lock.Unlock()
+	if ok {
+		// Another message created the session while we were waiting.
+		return session, nil
+	}
+	// Building may be slow (it loads the transcript and skills), so do not hold up other conversations while it happens.
+	runtime, err := m.builder.BuildNew(id)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	session = &Session{
+		id:           id,
+		builder:      m.builder,
+		runtime:      runtime,
+		lastActive:   time.Now(),
+		lastLocation: runtime.lastLocation,
+		policy:       m.policy,
+	}
+	m.sessions[id] = session
+	return session, nil
+}
+
+// hold waits until nothing else holds a conversation, then holds it until the returned function is called.
+func (m *SessionManager) hold(id string) func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for {
+		done, held := m.held[id]
+		if !held {
+			break
+		}
+		m.lock.Unlock()
+		<-done
+		m.lock.Lock()
+	}
+	done := make(chan struct{})
+	m.held[id] = done
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.held, id)
+		close(done)
+	}
+}
+
+// remove closes a session and removes it from the manager, the session must be locked and its conversation held.
+func (m *SessionManager) remove(session *Session) {
+	session.closed = true
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sessions[session.id] == session {
+		delete(m.sessions, session.id)
+	}
+}
+
+// Send sends a message to the session of a conversation, creating the session if it does not exist.
+func (m *SessionManager) Send(id string, msg Message, stream Stream) (Reply, error) {
+	for {
+		session, err := m.Get(id)
+		if err != nil {
+			return Reply{}, err
+		}
+		reply, err := session.Send(msg, stream)
+		if errors.Is(err, errSessionClosed) {
+			// The conversation was reset (or its session evicted) while the message waited, so send it to the new session.
+			continue
+		}
+		return reply, err
+	}
+}
+
+// Reset starts a conversation afresh, forgetting everything that has been said in it so far.
+// If the conversation is currently handling a message, the reset happens once it is done, and until then no other message can start a new session for it.
+func (m *SessionManager) Reset(id string, reason string) error {
+	release := m.hold(id)
+	defer release()
+	m.lock.Lock()
+	session, ok := m.sessions[id]
+	m.lock.Unlock()
+	if ok {
+		session.lock.Lock()
+		defer session.lock.Unlock()
+	}
+	recorder := &transcriptRecorder{transcripts: m.builder.transcripts, conversationID: id}
+	err := recorder.recordReset(reason)
+	if err != nil {
+		return err
+	}
+	if ok {
+		m.remove(session)
+	}
+	return nil
+}
+
+// Retract removes a message, and everything that happened in reply to it, from a conversation, returning false if the conversation does not contain the message.
+// If the conversation is currently handling a message, the message is removed once it is done.
+func (m *SessionManager) Retract(id string, messageID string) (bool, error) {
+	release := m.hold(id)
+	defer release()
+	m.lock.Lock()
+	session, ok := m.sessions[id]
+	m.lock.Unlock()
+	if ok {
+		session.lock.Lock()
+		defer session.lock.Unlock()
+		return session.runtime.Retract(messageID)
+	}
+	// The message can only be in the transcript, so record the retraction for when the session is next loaded.
+	transcript, err := m.builder.transcripts.Load(id)
+	if err != nil {
+		return false, err
+	}
+	if _, found := removeMessage(withoutRetracted(sinceLastReset(transcript)), messageID); !found {
+		return false, nil
+	}
+	recorder := &transcriptRecorder{transcripts: m.builder.transcripts, conversationID: id}
+	return true, recorder.recordRetraction(messageID, nil)
+}
+
+// SessionStatus describes the state of a conversation's session.
+type SessionStatus struct {
+	// Whether the conversation has a session, if not then none of the other fields are set.
+	Loaded bool
+	// Whether the session is currently handling a message, if so then the remaining fields are not set.
+	Busy         bool
+	Turns        int
+	StartedAt    time.Time
+	LastActive   time.Time
+	ApproxTokens int
+}
+
+// Status describes the session of a conversation, along with the total number of sessions.
+func (m *SessionManager) Status(id string) (SessionStatus, int) {
+	m.lock.Lock()
+	session, ok := m.sessions[id]
+	total := len(m.sessions)
+	m.lock.Unlock()
+	if !ok {
+		return SessionStatus{}, total
+	}
+	if !session.lock.TryLock() {
+		return SessionStatus{Loaded: true, Busy: true}, total
+	}
+	defer session.lock.Unlock()
+	return SessionStatus{
+		Loaded:       true,
+		Turns:        session.runtime.turns,
+		StartedAt:    session.runtime.startedAt,
+		LastActive:   session.lastActive,
+		ApproxTokens: approxTokens(session.runtime.recorder.pendingEntries()),
+	}, total
+}
+
+// EvictIdle removes all sessions that have not been active for longer than the idle timeout, returning their ids.
+// Sessions that are currently handling a message are never evicted.
+// The history of evicted sessions is summarised before they are removed, so that they can be cheaply restored from their transcript later,
+// and their conversations are held in the meantime so that no new session can be built from the transcript before the summary replaces it.
+func (m *SessionManager) EvictIdle() ([]string, error) {
+	ids := make([]string, 0)
+	var errs []error
+	for _, session := range m.idleSessions() {
+		evicted, err := m.evict(session)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to summarise session %s: %w", session.id, err))
+		}
+		if evicted {
+			ids = append(ids, session.id)
+		}
+	}
+	return ids, errors.Join(errs...)
+}
+
+// idleSessions lists the sessions that are not handling a message and have not been active for longer than the idle timeout.
+func (m *SessionManager) idleSessions() []*Session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	idle := make([]*Session, 0)
+	if m.policy.IdleTimeoutMinutes <= 0 {
+		return idle
+	}
+	for _, session := range m.sessions {
+		if !session.lock.TryLock() {
+			continue
+		}
+		if session.idle() {
+			idle = append(idle, session)
+		}
+		session.lock.Unlock()
+	}
+	return idle
+}
+
+// evict summarises the history of a session, then removes it, returning false if it was used (or removed) in the meantime.
+// The session is removed even if its history cannot be summarised, in which case it is restored from the full transcript later.
+func (m *SessionManager) evict(session *Session) (bool, error) {
+	release := m.hold(session.id)
+	defer release()
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.closed || !session.idle() {
+		return false, nil
+	}
+	_, err := session.runtime.summariseHistory(session.policy.Compaction)
+	m.remove(session)
+	return true, err
+}
+
+// idle checks whether the session has not been active for longer than the idle timeout, the session must be locked.
+func (s *Session) idle() bool {
+	return time.Since(s.lastActive) > time.Duration(s.policy.IdleTimeoutMinutes)*time.Minute
+}
+
+func (s *Session) Send(msg Message, stream Stream) (Reply, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return Reply{}, errSessionClosed
+	}
+	if reason, ok := s.resetReason(msg.Location); ok {
+		err := s.reset(reason)
+		if err != nil {
+			return Reply{}, err
+		}
+	}
+	s.lastActive = time.Now()
+	s.lastLocation = msg.Location
+	response, err := s.runtime.Send(msg, stream)
+	s.lastActive = time.Now()
+	if err == nil && s.runtime.NeedsCompaction(s.policy.Compaction) {
+		// Compact in the background so the reply is not held up.
+		// A message that is already waiting for the session may be sent before compaction starts, in which case it is compacted along with the rest afterwards.
+		go s.compact()
+	}
+	return response, err
+}
+
+// resetReason checks whether the policy requires the conversation to be reset before a message from a location is sent.
+func (s *Session) resetReason(location string) (string, bool) {
+	if s.policy.MaxTurns > 0 && s.runtime.turns >= s.policy.MaxTurns {
+		return "the maximum number of turns was reached", true
+	}
+	if s.policy.MaxAgeMinutes > 0 && time.Since(s.runtime.startedAt) > time.Duration(s.policy.MaxAgeMinutes)*time.Minute {
+		return "the maximum conversation age was reached", true
+	}
+	if s.policy.ResetOnLocationChange && s.lastLocation != "" && location != s.lastLocation {
+		return "the location changed", true
+	}
+	return "", false
+}
+
+func (s *Session) reset(reason string) error {
+	err := s.runtime.recorder.recordReset(reason)
+	if err != nil {
+		return err
+	}
+	runtime, err := s.builder.BuildNew(s.id)
+	if err != nil {
+		return err
+	}
+	s.runtime = runtime
+	slog.Info("Reset session", "conversation", s.id, "reason", reason)
+	return nil
+}
+
+func (s *Session) compact() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	err := s.runtime.Compact(s.policy.Compaction)
+	if err != nil {
+		slog.Warn("Failed to compact session", "conversation", s.id, "err", err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JoshPattman/react"
+)
+
+const defaultAttachmentLines = 200
+
+const maxAttachmentLines = 500
+
+// The most characters that are read at once, so that files with very long lines (such as minified code) are still read a piece at a time.
+const maxAttachmentChars = 10_000
+
+// AttachmentReader gives access to the files that have been attached to messages.
+type AttachmentReader interface {
+	Attachment(name string) (string, bool)
+	AttachmentNames() []string
+}
+
+func NewReadAttachmentTool(attachments AttachmentReader) react.Tool {
+	return &readAttachmentTool{attachments: attachments}
+}
+
+type readAttachmentTool struct {
+	attachments AttachmentReader
+}
+
+func (t *readAttachmentTool) Call(args map[string]any) (string, error) {
+	name, ok := args["name"].(string)
+	if !ok {
+		return "", errors.New("missing or invalid 'name'")
+	}
+	content, ok := t.attachments.Attachment(name)
+	if !ok {
+		names := t.attachments.AttachmentNames()
+		if len(names) == 0 {
+			return "", fmt.Errorf("there is no attachment called '%s', and there are no attachments available", name)
+		}
+		return "", fmt.Errorf("there is no attachment called '%s', the available attachments are: %s", name, strings.Join(names, ", "))
+	}
+
+	startLine := 1
+	if v, ok := args["start_line"].(float64); ok && v >= 1 {
+		startLine = int(v)
+	}
+	startColumn := 1
+	if v, ok := args["start_column"].(float64); ok && v >= 1 {
+		startColumn = int(v)
+	}
+	maxLines := defaultAttachmentLines
+	if v, ok := args["max_lines"].(float64); ok && v >= 1 {
+		maxLines = min(int(v), maxAttachmentLines)
+	}
+
+	lines := strings.Split(content, "\n")
+	if startLine > len(lines) {
+		return "", fmt.Errorf("'%s' only has %d lines", name, len(lines))
+	}
+	if first := []rune(lines[startLine-1]); startColumn > len(first)+1 {
+		return "", fmt.Errorf("line %d of '%s' only has %d characters", startLine, name, len(first))
+	}
+	endLine := min(startLine+maxLines-1, len(lines))
+	body := make([]string, 0)
+	continuation := ""
+	remaining := maxAttachmentChars
+	for i := startLine; i <= endLine; i++ {
+		line := []rune(lines[i-1])
+		if i == startLine {
+			line = line[startColumn-1:]
+		}
+		if len(line) > remaining {
+			if i > startLine {
+				// Leave the line for the next read, rather than cutting it short.
+				endLine = i - 1
+				continuation = fmt.Sprintf("[Stopped before line %d as it is long, read it with start_line=%d]", i, i)
+				break
+			}
+			column := startColumn + remaining
+			continuation = fmt.Sprintf("[Line %d continues, read the rest with start_line=%d and start_column=%d]", i, i, column)
+			line = line[:remaining]
+			endLine = i
+		}
+		body = append(body, fmt.Sprintf("%d: %s", i, string(line)))
+		remaining -= len(line)
+	}
+	header := fmt.Sprintf("Lines %d to %d of %d of '%s':", startLine, endLine, len(lines), name)
+	if startColumn > 1 {
+		header = fmt.Sprintf("Lines %d (from character %d) to %d of %d of '%s':", startLine, startColumn, endLine, len(lines), name)
+	}
+	result := append([]string{header}, body...)
+	if continuation != "" {
+		result = append(result, continuation)
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+func (t *readAttachmentTool) Name() string {
+	return "read_attachment"
+}
+
+func (t *readAttachmentTool) Description() []string {
+	return []string{
+		"Reads part of a file that was attached to a message, but was too large to be shown in the message",
+		"Arguments:",
+		"- name: the name of the attachment",
+		"- start_line (optional): the first line to read, starting from 1 (defaults to 1)",
+		"- start_column (optional): the character of the first line to start reading from, starting from 1 (defaults to 1), for continuing a long line that was cut off",
+		fmt.Sprintf("- max_lines (optional): the maximum number of lines to read (defaults to %d, at most %d)", defaultAttachmentLines, maxAttachmentLines),
+		fmt.Sprintf("At most %d characters are read at once, so fewer lines may be returned", maxAttachmentChars),
+	}
+}
@@ -0,0 +1,158 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JoshPattman/react"
+)
+
+// ChannelActions performs actions in the channel that the agent is currently talking in.
+// Message ids may be empty, in which case a sensible default message is used (documented on each method).
+type ChannelActions interface {
+	// React adds an emoji reaction to a message, by default the message the agent is replying to.
+	React(messageID string, emoji string) error
+	// Pin pins a message, by default the message the agent is replying to.
+	Pin(messageID string) error
+	// EditOwnMessage replaces the content of one of the agent's messages, by default its most recent message.
+	EditOwnMessage(messageID string, content string) error
+	// DeleteOwnMessage deletes one of the agent's messages, by default its most recent message.
+	DeleteOwnMessage(messageID string) error
+	// CreateThread starts a thread, from a message if one is given, returning a description of the new thread.
+	CreateThread(name string, messageID string) (string, error)
+	// ReadHistory reads messages from the channel, oldest first.
+	ReadHistory(query HistoryQuery) ([]HistoryMessage, error)
+}
+
+// ChannelActionsProvider gives the actions for the channel the agent is currently talking in, or nil if actions are not supported there.
+type ChannelActionsProvider interface {
+	ChannelActions() ChannelActions
+}
+
+var errNoChannelActions = errors.New("this action is not available in the current location")
+
+// channelTool is a tool that performs an action in the current channel.
+type channelTool struct {
+	provider    ChannelActionsProvider
+	name        string
+	description []string
+	call        func(actions ChannelActions, args map[string]any) (string, error)
+}
+
+func (t *channelTool) Call(args map[string]any) (string, error) {
+	actions := t.provider.ChannelActions()
+	if actions == nil {
+		return "", errNoChannelActions
+	}
+	return t.call(actions, args)
+}
+
+func (t *channelTool) Name() string {
+	return t.name
+}
+
+func (t *channelTool) Description() []string {
+	return t.description
+}
+
+// NewChannelTools creates the tools for reacting to, pinning, editing and deleting messages, and creating threads, in the current channel.
+func NewChannelTools(provider ChannelActionsProvider) []react.Tool {
+	return []react.Tool{
+		&channelTool{
+			provider: provider,
+			name:     "add_reaction",
+			description: []string{
+				"Adds an emoji reaction to a message in the current channel",
+				"Arguments:",
+				"- emoji: a unicode emoji (such as 👍), or a custom emoji in the form name:id",
+				"- message_id (optional): the message to react to, defaults to the message you are replying to",
+			},
+			call: func(actions ChannelActions, args map[string]any) (string, error) {
+				emoji, ok := args["emoji"].(string)
+				if !ok || emoji == "" {
+					return "", errors.New("missing or invalid 'emoji'")
+				}
+				messageID, _ := args["message_id"].(string)
+				if err := actions.React(messageID, emoji); err != nil {
+					return "", err
+				}
+				return "reaction added", nil
+			},
+		},
+		&channelTool{
+			provider: provider,
+			name:     "pin_message",
+			description: []string{
+				"Pins a message in the current channel",
+				"Arguments:",
+				"- message_id (optional): the message to pin, defaults to the message you are replying to",
+			},
+			call: func(actions ChannelActions, args map[string]any) (string, error) {
+				messageID, _ := args["message_id"].(string)
+				if err := actions.Pin(messageID); err != nil {
+					return "", err
+				}
+				return "message pinned", nil
+			},
+		},
+		&channelTool{
+			provider: provider,
+			name:     "edit_message",
+			description: []string{
+				"Replaces the content of one of your own previous messages in the current channel",
+				"Arguments:",
+				"- content: the new content of the message",
+				"- message_id (optional): the message to edit, defaults to your most recent message before the one you are replying to",
+			},
+			call: func(actions ChannelActions, args map[string]any) (string, error) {
+				content, ok := args["content"].(string)
+				if !ok || content == "" {
+					return "", errors.New("missing or invalid 'content'")
+				}
+				messageID, _ := args["message_id"].(string)
+				if err := actions.EditOwnMessage(messageID, content); err != nil {
+					return "", err
+				}
+				return "message edited", nil
+			},
+		},
+		&channelTool{
+			provider: provider,
+			name:     "delete_message",
+			description: []string{
+				"Deletes one of your own previous messages in the current channel",
+				"Arguments:",
+				"- message_id (optional): the message to delete, defaults to your most recent message before the one you are replying to",
+			},
+			call: func(actions ChannelActions, args map[string]any) (string, error) {
+				messageID, _ := args["message_id"].(string)
+				if err := actions.DeleteOwnMessage(messageID); err != nil {
+					return "", err
+				}
+				return "message deleted", nil
+			},
+		},
+		&channelTool{
+			provider: provider,
+			name:     "create_thread",
+			description: []string{
+				"Starts a new thread in the current channel",
+				"Arguments:",
+				"- name: the name of the thread",
+				"- message_id (optional): a message to start the thread from, if not given the thread is not attached to a message",
+			},
+			call: func(actions ChannelActions, args map[string]any) (string, error) {
+				name, ok := args["name"].(string)
+				if !ok || name == "" {
+					return "", errors.New("missing or invalid 'name'")
+				}
+				messageID, _ := args["message_id"].(string)
+				thread, err := actions.CreateThread(name, messageID)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("thread created: %s", thread), nil
+			},
+		},
+	}
+}
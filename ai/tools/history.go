@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JoshPattman/react"
+)
+
+const defaultHistoryMessages = 50
+
+const maxHistoryMessages = 200
+
+// HistoryQuery selects messages from the history of a channel.
+// Zero values mean no restriction.
+type HistoryQuery struct {
+	// The maximum number of messages to return, the most recent matching messages are returned.
+	Limit  int
+	After  time.Time
+	Before time.Time
+	// Only include messages from authors whose name contains this (ignoring case).
+	Author string
+	// Read the channel that the current thread is in, rather than the thread itself.
+	Parent bool
+}
+
+// HistoryMessage is a message from the history of a channel.
+type HistoryMessage struct {
+	ID          string
+	Time        time.Time
+	Author      string
+	Content     string
+	Attachments []string
+	// Whether the message was sent by the agent.
+	FromAgent bool
+}
+
+func NewReadChannelHistoryTool(provider ChannelActionsProvider) react.Tool {
+	return &readChannelHistoryTool{provider: provider}
+}
+
+type readChannelHistoryTool struct {
+	provider ChannelActionsProvider
+}
+
+func (t *readChannelHistoryTool) Call(args map[string]any) (string, error) {
+	actions := t.provider.ChannelActions()
+	if actions == nil {
+		return "", errNoChannelActions
+	}
+	query := HistoryQuery{Limit: defaultHistoryMessages}
+	if v, ok := args["limit"].(float64); ok && v >= 1 {
+		query.Limit = min(int(v), maxHistoryMessages)
+	}
+	if v, ok := args["since_minutes"].(float64); ok && v > 0 {
+		query.After = time.Now().Add(-time.Duration(v * float64(time.Minute)))
+	}
+	for key, into := range map[string]*time.Time{"after": &query.After, "before": &query.Before} {
+		v, ok := args[key].(string)
+		if !ok || v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", fmt.Errorf("'%s' must be a time such as %s", key, time.Now().Format(time.RFC3339))
+		}
+		*into = parsed
+	}
+	query.Author, _ = args["author"].(string)
+	query.Parent, _ = args["parent"].(bool)
+
+	messages, err := actions.ReadHistory(query)
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "no messages matched", nil
+	}
+	lines := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		author := msg.Author
+		if msg.FromAgent {
+			author += " (you)"
+		}
+		line := fmt.Sprintf("[%s] (id %s) %s: %s", msg.Time.Format("2006-01-02 15:04"), msg.ID, author, msg.Content)
+		if len(msg.Attachments) > 0 {
+			line += fmt.Sprintf(" [attachments: %s]", strings.Join(msg.Attachments, ", "))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (t *readChannelHistoryTool) Name() string {
+	return "read_channel_history"
+}
+
+func (t *readChannelHistoryTool) Description() []string {
+	return []string{
+		"Reads recent messages from the channel (or thread) you are talking in, including messages that were not sent to you",
+		"Use this to catch up on a conversation, for example when asked to summarise what was discussed",
+		"Messages are returned oldest first, with their ids, which can be used with other tools",
+		"Arguments (all optional):",
+		fmt.Sprintf("- limit: the maximum number of messages, the most recent are returned (defaults to %d, at most %d)", defaultHistoryMessages, maxHistoryMessages),
+		"- since_minutes: only messages from the last this many minutes",
+		"- after / before: only messages after / before a time, such as " + time.Now().Format(time.RFC3339),
+		"- author: only messages from people whose name contains this",
+		"- parent: if true and you are in a thread, read the channel the thread is in instead",
+	}
+}
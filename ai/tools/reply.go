@@ -0,0 +1,164 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JoshPattman/react"
+)
+
+// ReplyFile is a file that is sent along with the agent's reply.
+type ReplyFile struct {
+	Name    string
+	Content string
+}
+
+// ReplyEmbed is a rich card that is sent along with the agent's reply, on frontends that support them.
+type ReplyEmbed struct {
+	Title       string
+	Description string
+	URL         string
+	Color       int
+	Fields      []ReplyEmbedField
+}
+
+type ReplyEmbedField struct {
+	Name   string
+	Value  string
+	Inline bool
+}
+
+// ReplyAttachments collects the files and embeds to send along with the agent's next reply.
+type ReplyAttachments interface {
+	AttachFile(file ReplyFile) error
+	AddEmbed(embed ReplyEmbed) error
+}
+
+// Files larger than this many characters cannot be attached.
+const maxReplyFileChars = 1_000_000
+
+// These follow discord's limits, which are the strictest of the frontends that support embeds.
+const (
+	maxEmbedTitleChars       = 256
+	maxEmbedDescriptionChars = 4096
+	maxEmbedFields           = 25
+	maxEmbedFieldNameChars   = 256
+	maxEmbedFieldValueChars  = 1024
+)
+
+func NewAttachFileTool(attachments ReplyAttachments) react.Tool {
+	return &attachFileTool{attachments: attachments}
+}
+
+type attachFileTool struct {
+	attachments ReplyAttachments
+}
+
+func (t *attachFileTool) Call(args map[string]any) (string, error) {
+	name, ok := args["name"].(string)
+	if !ok || strings.TrimSpace(name) == "" {
+		return "", errors.New("missing or invalid 'name'")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return "", errors.New("'name' must be a file name, not a path")
+	}
+	content, ok := args["content"].(string)
+	if !ok {
+		return "", errors.New("missing or invalid 'content'")
+	}
+	if len(content) > maxReplyFileChars {
+		return "", fmt.Errorf("'content' is too long, files can be at most %d characters", maxReplyFileChars)
+	}
+	if err := t.attachments.AttachFile(ReplyFile{Name: name, Content: content}); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s will be attached to your reply", name), nil
+}
+
+func (t *attachFileTool) Name() string {
+	return "attach_file"
+}
+
+func (t *attachFileTool) Description() []string {
+	return []string{
+		"Attaches a text file to your next reply, which is useful for generated content such as CSVs, long code, or diagrams-as-text",
+		"Only use this for content that is more useful as a file than as part of the message",
+		"Arguments:",
+		"- name: the file name, including an extension (e.g. data.csv)",
+		"- content: the content of the file",
+	}
+}
+
+func NewAddEmbedTool(attachments ReplyAttachments) react.Tool {
+	return &addEmbedTool{attachments: attachments}
+}
+
+type addEmbedTool struct {
+	attachments ReplyAttachments
+}
+
+func (t *addEmbedTool) Call(args map[string]any) (string, error) {
+	embed := ReplyEmbed{}
+	embed.Title, _ = args["title"].(string)
+	embed.Description, _ = args["description"].(string)
+	embed.URL, _ = args["url"].(string)
+	if embed.Title == "" && embed.Description == "" {
+		return "", errors.New("at least one of 'title' and 'description' must be given")
+	}
+	if len([]rune(embed.Title)) > maxEmbedTitleChars {
+		return "", fmt.Errorf("'title' can be at most %d characters", maxEmbedTitleChars)
+	}
+	if len([]rune(embed.Description)) > maxEmbedDescriptionChars {
+		return "", fmt.Errorf("'description' can be at most %d characters", maxEmbedDescriptionChars)
+	}
+	if color, ok := args["color"].(string); ok && color != "" {
+		c, err := strconv.ParseUint(strings.TrimPrefix(color, "#"), 16, 24)
+		if err != nil {
+			return "", errors.New("'color' must be a hex colour such as #5865F2")
+		}
+		embed.Color = int(c)
+	}
+	fields, _ := args["fields"].([]any)
+	if len(fields) > maxEmbedFields {
+		return "", fmt.Errorf("there can be at most %d fields", maxEmbedFields)
+	}
+	for _, field := range fields {
+		field, ok := field.(map[string]any)
+		if !ok {
+			return "", errors.New("each field must be an object with 'name' and 'value'")
+		}
+		name, _ := field["name"].(string)
+		value, _ := field["value"].(string)
+		inline, _ := field["inline"].(bool)
+		if name == "" || value == "" {
+			return "", errors.New("each field must have a 'name' and a 'value'")
+		}
+		if len([]rune(name)) > maxEmbedFieldNameChars || len([]rune(value)) > maxEmbedFieldValueChars {
+			return "", fmt.Errorf("field names can be at most %d characters, and values at most %d", maxEmbedFieldNameChars, maxEmbedFieldValueChars)
+		}
+		embed.Fields = append(embed.Fields, ReplyEmbedField{Name: name, Value: value, Inline: inline})
+	}
+	if err := t.attachments.AddEmbed(embed); err != nil {
+		return "", err
+	}
+	return "the embed will be added to your reply", nil
+}
+
+func (t *addEmbedTool) Name() string {
+	return "add_embed"
+}
+
+func (t *addEmbedTool) Description() []string {
+	return []string{
+		"Adds a rich card (an embed) to your next reply, which is useful for structured information such as a summary with a few key values",
+		"Where embeds are not supported, they are shown as text instead",
+		"Arguments:",
+		fmt.Sprintf("- title (optional): the title, at most %d characters", maxEmbedTitleChars),
+		fmt.Sprintf("- description (optional): the markdown body, at most %d characters", maxEmbedDescriptionChars),
+		"- url (optional): a link for the title",
+		"- color (optional): a hex colour for the side of the card, such as #5865F2",
+		fmt.Sprintf("- fields (optional): a list of at most %d objects with 'name', 'value' and optionally 'inline' (a boolean)", maxEmbedFields),
+	}
+}
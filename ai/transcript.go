@@ -0,0 +1,198 @@
+package ai
+
+import (
+	"craig/data"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/JoshPattman/react"
+)
+
+// The maximum number of transcript entries that are carried into a restored session.
+const maxRestoredTranscriptEntries = 100
+
+// The maximum length of a tool result that is recorded in the transcript.
+const maxRecordedToolResultLen = 500
+
+// transcriptRecorder writes the events of a single conversation to its transcript,
+// and keeps track of the entries that have been recorded since the conversation was last summarised.
+type transcriptRecorder struct {
+	lock           sync.Mutex
+	transcripts    data.Transcripts
+	conversationID string
+	pending        []data.TranscriptEntry
+}
+
+func (t *transcriptRecorder) record(entries ...data.TranscriptEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := range entries {
+		entries[i].Time = time.Now()
+	}
+	t.pending = append(t.pending, entries...)
+	return t.transcripts.Append(t.conversationID, entries...)
+}
+
+// recordReset records that the conversation has been reset, which discards all pending entries.
+// Nothing before a reset is restored, so the transcript is started again from the reset.
+func (t *transcriptRecorder) recordReset(reason string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = nil
+	return t.transcripts.Replace(t.conversationID, data.TranscriptEntry{
+		Time:    time.Now(),
+		Kind:    data.TranscriptReset,
+		Content: reason,
+	})
+}
+
+// recordSummary records a summary, which replaces all pending entries.
+// The summary covers everything before it, so the transcript is started again from the summary, which keeps the number of turns and start time of the conversation.
+func (t *transcriptRecorder) recordSummary(summary string, turns int, startedAt time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = nil
+	return t.transcripts.Replace(t.conversationID, data.TranscriptEntry{
+		Time:      time.Now(),
+		Kind:      data.TranscriptSummary,
+		Content:   summary,
+		Turns:     turns,
+		StartedAt: startedAt,
+	})
+}
+
+// recordRetraction records that a message has been removed from the conversation, replacing the pending entries with the ones that remain.
+func (t *transcriptRecorder) recordRetraction(messageID string, remaining []data.TranscriptEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = remaining
+	return t.transcripts.Append(t.conversationID, data.TranscriptEntry{
+		Time:       time.Now(),
+		Kind:       data.TranscriptRetraction,
+		MessageIDs: []string{messageID},
+	})
+}
+
+func (t *transcriptRecorder) pendingEntries() []data.TranscriptEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return slices.Clone(t.pending)
+}
+
+// sinceLastReset returns the entries that came after the most recent reset of a transcript.
+func sinceLastReset(entries []data.TranscriptEntry) []data.TranscriptEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == data.TranscriptReset {
+			return entries[i+1:]
+		}
+	}
+	return entries
+}
+
+// withoutRetracted removes the messages that have been retracted from a transcript, along with the retractions themselves.
+func withoutRetracted(entries []data.TranscriptEntry) []data.TranscriptEntry {
+	kept := make([]data.TranscriptEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Kind == data.TranscriptRetraction {
+			for _, messageID := range entry.MessageIDs {
+				kept, _ = removeMessage(kept, messageID)
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// removeMessage removes the most recent user message with an id (which may be one of several messages that were combined) from a transcript, along with everything that happened in reply to it.
+// It returns false if the transcript does not contain the message.
+func removeMessage(entries []data.TranscriptEntry, messageID string) ([]data.TranscriptEntry, bool) {
+	if messageID == "" {
+		return entries, false
+	}
+	start := -1
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == data.TranscriptUserMessage && slices.Contains(entries[i].MessageIDs, messageID) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return entries, false
+	}
+	end := start + 1
+	for end < len(entries) && !slices.Contains([]string{data.TranscriptUserMessage, data.TranscriptSummary, data.TranscriptReset}, entries[end].Kind) {
+		end++
+	}
+	return append(slices.Clone(entries[:start]), entries[end:]...), true
+}
+
+// latestSummary finds the most recent summary in a transcript, returning it along with the entries that came after it.
+func latestSummary(entries []data.TranscriptEntry) (string, []data.TranscriptEntry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == data.TranscriptSummary {
+			return entries[i].Content, entries[i+1:]
+		}
+	}
+	return "", entries
+}
+
+// recordingTool records each call of the wrapped tool in the transcript.
+type recordingTool struct {
+	react.Tool
+	recorder *transcriptRecorder
+}
+
+func (t *recordingTool) Call(args map[string]any) (string, error) {
+	result, err := t.Tool.Call(args)
+	argsJson, _ := json.Marshal(args)
+	outcome := result
+	if err != nil {
+		outcome = "error: " + err.Error()
+	}
+	if len(outcome) > maxRecordedToolResultLen {
+		// Cut at the start of a character, so the transcript stays valid UTF-8.
+		cut := maxRecordedToolResultLen
+		for cut > 0 && !utf8.RuneStart(outcome[cut]) {
+			cut--
+		}
+		outcome = outcome[:cut] + "..."
+	}
+	recErr := t.recorder.record(data.TranscriptEntry{
+		Kind:    data.TranscriptToolCall,
+		Content: fmt.Sprintf("%s(%s) -> %s", t.Tool.Name(), argsJson, outcome),
+	})
+	if recErr != nil {
+		slog.Warn("Failed to record tool call", "conversation", t.recorder.conversationID, "err", recErr.Error())
+	}
+	return result, err
+}
+
+// formatTranscript renders transcript entries as text that the agent can read.
+func formatTranscript(entries []data.TranscriptEntry) string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		timestamp := entry.Time.Format(time.ANSIC)
+		switch entry.Kind {
+		case data.TranscriptUserMessage:
+			lines = append(lines, fmt.Sprintf("[%s] %s (in %s): %s", timestamp, entry.Author, entry.Location, entry.Content))
+		case data.TranscriptSummary:
+			lines = append(lines, fmt.Sprintf("[%s] summary of the conversation up to this point: %s", timestamp, entry.Content))
+		case data.TranscriptReply:
+			content := entry.Content
+			if content == "" {
+				content = "(chose not to reply)"
+			}
+			lines = append(lines, fmt.Sprintf("[%s] you: %s", timestamp, content))
+		default:
+			lines = append(lines, fmt.Sprintf("[%s] %s: %s", timestamp, entry.Kind, entry.Content))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -9,13 +9,12 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	_ "embed"
 
 	"github.com/JoshPattman/react"
-	"github.com/bwmarrin/discordgo"
 )
 
 //go:embed defaults
@@ -42,121 +41,394 @@ func NewApp(openAIKey, geminiKey string, logger *slog.Logger, dataLocation strin
 		return nil, err
 	}
 
+	toolPermissions, err := dd.ToolPermissions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect to the MCP servers once, so that a broken config fails at startup, and every conversation shares the connections.
+	tools, err := dd.EnabledTools()
+	if err != nil {
+		return nil, err
+	}
+
 	modelBuilder := ai.NewModelBuilder(agentSetup, filterSetup, openAIKey, geminiKey)
 	agentBuilder := ai.NewAgentBuilder(
 		modelBuilder,
 		dd.GetScratchPad(),
 		dd.GetSkillset(),
 		dd,
-		dd,
+		tools,
+		dd.GetTranscripts(),
+		toolPermissions,
 	)
 
-	app := &App{
-		logger:       logger,
-		aiLock:       &sync.Mutex{},
-		agentBuilder: agentBuilder,
+	sessionPolicy, err := dd.SessionPolicy()
+	if err != nil {
+		return nil, err
 	}
-	err = app.resetAgent()
+
+	triggerPolicy, err := dd.TriggerPolicy()
+	if err != nil {
+		return nil, err
+	}
+	triggers, err := newTriggerPolicy(triggerPolicy, ai.NewReplyFilter(modelBuilder))
 	if err != nil {
 		return nil, err
 	}
+
+	app := &App{
+		logger:   logger,
+		data:     dd,
+		sessions: ai.NewSessionManager(agentBuilder, sessionPolicy),
+		triggers: triggers,
+		batcher:  newMessageBatcher(sessionPolicy.Batching),
+		batches:  newAnsweredBatches(),
+	}
+	go app.evictIdleSessions()
 	return app, nil
 }
 
 type App struct {
-	agent        *ai.AgentRuntime
-	lastMessage  time.Time
-	logger       *slog.Logger
-	aiLock       *sync.Mutex
-	agentBuilder *ai.AgentBuilder
+	logger   *slog.Logger
+	data     *data.DirectoryData
+	sessions agentSessions
+	triggers *triggerPolicy
+	batcher  *messageBatcher
+	batches  *answeredBatches
+}
+
+// agentSessions runs the agent for each conversation, it is implemented by ai.SessionManager (and stood in for by tests).
+type agentSessions interface {
+	Send(conversationID string, msg ai.Message, stream ai.Stream) (ai.Reply, error)
+	Retract(conversationID string, messageID string) (bool, error)
+	Reset(conversationID string, reason string) error
+	Status(conversationID string) (ai.SessionStatus, int)
+	EvictIdle() ([]string, error)
 }
 
 const internalErrMessage = "There was an error processing this request"
 
-func (app *App) OnMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if m.Author.ID == s.State.User.ID {
+// Sending this message resets the conversation it is sent in.
+const resetCommand = "!reset"
+
+const resetMessage = "I have forgotten this conversation, let's start afresh"
+
+const resetNotAllowedMessage = "Only private conversations can be reset by sending " + resetCommand + ", as other people are part of this one. An administrator can still reset it."
+
+func (app *App) HandleMessage(msg IncomingMessage, sink ReplySink) {
+	app.logger.Info("Message received", "from", msg.Author.Name, "conversation", msg.Conversation.ID, "location", msg.Conversation.Location)
+	if strings.EqualFold(strings.TrimSpace(msg.Content), resetCommand) {
+		// Anyone can post in a shared conversation, so resetting those needs an admin command instead.
+		if !msg.Conversation.Private {
+			sink.Reply(resetNotAllowedMessage)
+			return
+		}
+		app.resetConversation(msg, sink)
+		return
+	}
+	if batch := app.batcher.join(msg, sink); batch != nil {
+		// The message will be answered along with the earlier messages it follows, which have already triggered the agent.
+		app.logger.Info("Message added to batch", "conversation", msg.Conversation.ID)
+		<-batch.done
 		return
 	}
-	sendData, err := app.getMessageSendData(s, m)
+	shouldRun, reason, err := app.triggers.ShouldRun(msg)
 	if err != nil {
-		app.logger.Error("Failed to get message send data", "err", err.Error())
-		s.ChannelMessageSend(m.ChannelID, internalErrMessage)
+		// It is better to run the agent needlessly than to miss a message.
+		app.logger.Error("Failed to check triggers, running agent anyway", "err", err.Error())
+	} else if !shouldRun {
+		app.logger.Info("Message did not trigger agent", "reason", reason)
 		return
+	} else {
+		app.logger.Info("Message triggered agent", "reason", reason)
 	}
-	app.logger.Info("Message received", "from", sendData.authorName, "location", sendData.LocationString())
-	response, err := app.getAgentResponseHelper(m.Content, sendData.authorName, sendData.LocationString())
+	app.respondBatched(msg, sink)
+}
+
+// HandleEdit answers a message again after it has been edited, forgetting the original message and the reply to it.
+// If the message was answered along with others, they are all answered again, with the edited message in place of the original.
+// The message was already answered, so the triggers are not checked again.
+func (app *App) HandleEdit(msg IncomingMessage, sink ReplySink) {
+	app.logger.Info("Message edited", "from", msg.Author.Name, "conversation", msg.Conversation.ID, "message", msg.ID)
+	_, err := app.sessions.Retract(msg.Conversation.ID, msg.ID)
 	if err != nil {
-		app.logger.Error("Failed to call agent", "err", err.Error())
-		s.ChannelMessageSend(m.ChannelID, internalErrMessage)
+		// The agent will see both versions of the message, which is better than not answering the edited one.
+		app.logger.Error("Failed to remove original message", "err", err.Error())
+	}
+	messages := app.batches.withEdit(loadDetails(msg))
+	app.respond(combineMessages(messages), sink, nil)
+	app.answered(messages, []ReplySink{sink}, sink)
+}
+
+// HandleDelete forgets a deleted message, and the reply to it.
+// If the reply also answered other messages, and there is a sink to replace it with, the rest of them are answered again.
+func (app *App) HandleDelete(conversationID string, messageID string, sink ReplySink) {
+	remaining := app.batches.withoutDeleted(messageID)
+	retracted, err := app.sessions.Retract(conversationID, messageID)
+	if err != nil {
+		app.logger.Error("Failed to remove deleted message", "conversation", conversationID, "message", messageID, "err", err.Error())
 		return
 	}
-	app.logger.Info("Response generated", "len", len(response))
-	if len(response) == 0 {
+	if retracted {
+		app.logger.Info("Removed deleted message", "conversation", conversationID, "message", messageID)
+	}
+	if len(remaining) == 0 || sink == nil {
 		return
 	}
-	_, err = s.ChannelMessageSend(m.ChannelID, response)
+	app.logger.Info("Answering the rest of the deleted message's batch", "conversation", conversationID, "messages", len(remaining))
+	app.respond(combineMessages(remaining), sink, nil)
+	app.answered(remaining, []ReplySink{sink}, sink)
+}
+
+// respond runs the agent for a message and sends its reply, returning false if the reply was abandoned because the turn became stale.
+// The turn may be nil if the message is not part of a batch.
+func (app *App) respond(msg IncomingMessage, sink ReplySink, turn *batchTurn) bool {
+	msg = loadDetails(msg)
+	if typingSink, ok := sink.(TypingReplySink); ok {
+		stopTyping := typingSink.StartTyping()
+		defer stopTyping()
+	}
+	var stream ai.Stream
+	streamSink, isStreaming := sink.(StreamingReplySink)
+	// Once the turn is stale its reply will be abandoned, so nothing more of it is shown.
+	if isStreaming {
+		stream.OnBegin = func() {
+			if !turn.stale() {
+				streamSink.BeginStream()
+			}
+		}
+		stream.OnText = func(text string) {
+			if !turn.stale() {
+				streamSink.StreamText(text)
+			}
+		}
+	}
+	if statusSink, ok := sink.(StatusReplySink); ok {
+		stream.OnToolCall = func(toolName string) {
+			if !turn.stale() {
+				statusSink.ShowStatus(describeToolCall(toolName))
+			}
+		}
+	}
+	reply, err := app.getAgentResponseHelper(msg, stream)
+	if !turn.finish() {
+		if isStreaming {
+			streamSink.CancelStream()
+		}
+		return false
+	}
+	if err != nil {
+		app.logger.Error("Failed to call agent", "err", err.Error())
+		replyError(sink)
+		return true
+	}
+	app.logger.Info("Response generated", "len", len(reply.Text), "files", len(reply.Files), "embeds", len(reply.Embeds))
+	if reply.IsEmpty() {
+		if isStreaming {
+			streamSink.CancelStream()
+		}
+		return true
+	}
+	err = sendReply(sink, reply)
 	if err != nil {
 		app.logger.Error("Failed to send response", "err", err.Error())
-		s.ChannelMessageSend(m.ChannelID, internalErrMessage)
-		return
+		replyError(sink)
+		return true
 	}
+	app.triggers.Replied(msg.Conversation.ID)
 	app.logger.Info("Replied")
+	return true
 }
 
-func (app *App) getAgentResponseHelper(msg string, author string, location string) (string, error) {
-	if time.Since(app.lastMessage) > time.Hour {
-		err := app.resetAgent()
-		if err != nil {
-			return "", err
+// loadDetails fills in the details of a message that the frontend only looks up when they are needed.
+func loadDetails(msg IncomingMessage) IncomingMessage {
+	if msg.LoadDetails != nil {
+		msg.LoadDetails(&msg)
+		msg.LoadDetails = nil
+	}
+	return msg
+}
+
+// replyError tells the sender of a message that it could not be answered.
+func replyError(sink ReplySink) {
+	if errorSink, ok := sink.(ErrorReplySink); ok {
+		errorSink.ReplyError(internalErrMessage)
+		return
+	}
+	sink.Reply(internalErrMessage)
+}
+
+// sendReply sends a reply to a sink, showing files and embeds as text if the sink cannot send them.
+func sendReply(sink ReplySink, reply ai.Reply) error {
+	richSink, ok := sink.(RichReplySink)
+	if !ok || (len(reply.Files) == 0 && len(reply.Embeds) == 0) {
+		return sink.Reply(replyAsText(reply))
+	}
+	files := make([]ReplyFile, len(reply.Files))
+	for i, file := range reply.Files {
+		files[i] = ReplyFile{Name: file.Name, Content: file.Content}
+	}
+	embeds := make([]ReplyEmbed, len(reply.Embeds))
+	for i, embed := range reply.Embeds {
+		embeds[i] = ReplyEmbed{Title: embed.Title, Description: embed.Description, URL: embed.URL, Color: embed.Color}
+		for _, field := range embed.Fields {
+			embeds[i].Fields = append(embeds[i].Fields, ReplyEmbedField{Name: field.Name, Value: field.Value, Inline: field.Inline})
+		}
+	}
+	return richSink.RichReply(reply.Text, files, embeds)
+}
+
+// replyAsText converts the files and embeds of a reply into markdown, appended to the text of the reply.
+func replyAsText(reply ai.Reply) string {
+	parts := []string{reply.Text}
+	for _, embed := range reply.Embeds {
+		lines := make([]string, 0)
+		if embed.Title != "" {
+			lines = append(lines, "**"+embed.Title+"**")
 		}
-		app.lastMessage = time.Now()
-		app.logger.Info("Resetting agent due to long time since last conversation")
+		if embed.Description != "" {
+			lines = append(lines, embed.Description)
+		}
+		for _, field := range embed.Fields {
+			lines = append(lines, fmt.Sprintf("- **%s**: %s", field.Name, field.Value))
+		}
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+	for _, file := range reply.Files {
+		parts = append(parts, fmt.Sprintf("`%s`\n```\n%s\n```", file.Name, file.Content))
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n\n"))
+}
+
+// describeToolCall gives a short description of what the agent is doing when it calls a tool.
+func describeToolCall(toolName string) string {
+	switch toolName {
+	case "get_time":
+		return "checking the time"
+	case "read_scratchpad":
+		return "reading scratchpad"
+	case "rewrite_scratchpad":
+		return "updating scratchpad"
+	case "read_attachment":
+		return "reading attachment"
+	case "attach_file":
+		return "attaching a file"
+	case "add_embed":
+		return "adding an embed"
+	case "add_reaction":
+		return "reacting"
+	case "pin_message":
+		return "pinning a message"
+	case "edit_message":
+		return "editing a message"
+	case "delete_message":
+		return "deleting a message"
+	case "create_thread":
+		return "creating a thread"
+	case "read_channel_history":
+		return "reading the channel history"
+	default:
+		return "using " + strings.ReplaceAll(toolName, "_", " ")
 	}
-	app.aiLock.Lock()
-	response, err := app.agent.Send(msg, author, location)
-	app.aiLock.Unlock()
+}
+
+func (app *App) resetConversation(msg IncomingMessage, sink ReplySink) {
+	err := app.ResetConversation(msg.Conversation.ID, msg.Author.Name)
 	if err != nil {
-		return "", err
+		app.logger.Error("Failed to reset conversation", "err", err.Error())
+		replyError(sink)
+		return
 	}
-	return response, nil
+	sink.Reply(resetMessage)
 }
 
-type messageSendData struct {
-	authorName          string
-	channelName         string
-	guildName           string
-	conversationMembers int
+func (app *App) getAgentResponseHelper(msg IncomingMessage, stream ai.Stream) (ai.Reply, error) {
+	return app.sessions.Send(msg.Conversation.ID, withAttachments(agentMessage(msg), msg.Attachments), stream)
 }
 
-func (d messageSendData) LocationString() string {
-	return fmt.Sprintf("Discord(server='%s', channel='%s', channel_n_members_including_you=%d)", d.guildName, d.channelName, d.conversationMembers)
+// agentMessage converts a message from a frontend into a message for the agent.
+func agentMessage(msg IncomingMessage) ai.Message {
+	agentMsg := ai.Message{
+		IDs:       msg.CombinedIDs,
+		Content:   msg.Content,
+		UserName:  msg.Author.Name,
+		Location:  msg.Conversation.Location,
+		UserID:    msg.Author.ID,
+		UserRoles: msg.Author.Roles,
+		Actions:   msg.Actions,
+	}
+	if agentMsg.IDs == nil && msg.ID != "" {
+		agentMsg.IDs = []string{msg.ID}
+	}
+	if len(msg.ReplyChain) > 0 {
+		agentMsg.Context = append(agentMsg.Context, ai.MessageContext{
+			Kind:    "reply_chain",
+			Content: describeReplyChain(msg.ReplyChain),
+		})
+	}
+	if audience := describeAudience(msg.Conversation.Audience); audience != "" {
+		agentMsg.Context = append(agentMsg.Context, ai.MessageContext{
+			Kind:         "audience",
+			Content:      "The audience of the location you are in has changed: " + audience,
+			OnlyOnChange: true,
+		})
+	}
+	return agentMsg
 }
 
-func (app *App) getMessageSendData(s *discordgo.Session, m *discordgo.MessageCreate) (messageSendData, error) {
-	name := m.Author.DisplayName()
-	channel, err := s.Channel(m.ChannelID)
-	if err != nil {
-		app.logger.Error("Failed to get channel", "err", err.Error())
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprint(err))
-		return messageSendData{}, err
+// Quoted messages are cut down to this many characters when they are shown to the agent.
+const maxQuotedMessageChars = 1000
+
+// describeReplyChain describes the messages that a message is replying to, oldest first so it reads like a conversation.
+func describeReplyChain(chain []QuotedMessage) string {
+	lines := []string{"The message you are about to receive is a reply. Here is the chain of messages it is replying to, oldest first:"}
+	for i := len(chain) - 1; i >= 0; i-- {
+		quoted := chain[i]
+		author := quoted.AuthorName
+		if quoted.FromAgent {
+			author += " (you)"
+		}
+		content := quoted.Content
+		if runes := []rune(content); len(runes) > maxQuotedMessageChars {
+			content = string(runes[:maxQuotedMessageChars-1]) + "…"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", author, content))
 	}
-	guild, err := s.GuildWithCounts(channel.GuildID)
-	if err != nil {
-		app.logger.Error("Failed to get guild", "err", err.Error())
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprint(err))
-		return messageSendData{}, err
+	return strings.Join(lines, "\n")
+}
+
+func describeAudience(audience Audience) string {
+	parts := make([]string, 0)
+	if audience.Members > 0 {
+		parts = append(parts, fmt.Sprintf("channel_n_members_including_you=%d (everyone who can see this location)", audience.Members))
+	}
+	if audience.ActiveParticipants != nil {
+		parts = append(parts, fmt.Sprintf("recently_active_participants=%s (people who have sent messages here recently)", quoteNames(audience.ActiveParticipants)))
 	}
-	return messageSendData{
-		authorName:          name,
-		channelName:         channel.Name,
-		guildName:           guild.Name,
-		conversationMembers: guild.ApproximateMemberCount,
-	}, nil
+	if audience.ThreadMembers != nil {
+		parts = append(parts, fmt.Sprintf("thread_members=%s (people who have joined this thread)", quoteNames(audience.ThreadMembers)))
+	}
+	return strings.Join(parts, ", ")
 }
 
-func (app *App) resetAgent() (err error) {
-	app.agent, err = app.agentBuilder.BuildNew()
-	return err
+func quoteNames(names []string) string {
+	if len(names) == 0 {
+		return "[]"
+	}
+	return "['" + strings.Join(names, "', '") + "']"
+}
+
+func (app *App) evictIdleSessions() {
+	for range time.Tick(time.Minute) {
+		ids, err := app.sessions.EvictIdle()
+		for _, id := range ids {
+			app.logger.Info("Evicted idle session", "conversation", id)
+		}
+		if err != nil {
+			app.logger.Error("Failed to summarise evicted sessions", "err", err.Error())
+		}
+	}
 }
 
 func loadSkills(skillLocation string) ([]react.Skill, error) {
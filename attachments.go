@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"craig/ai"
+	"fmt"
+	"image"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Images larger than this are not downloaded.
+const maxImageBytes = 10 << 20
+
+// Images with more pixels than this are not decoded, as a small file can declare a huge image that would fill memory.
+const maxImagePixels = 25_000_000
+
+// Only this many images from a single message are shown to the agent.
+const maxImagesPerMessage = 4
+
+// Files larger than this are not downloaded.
+const maxFileBytes = 5 << 20
+
+// The text of a file is cut down to this many characters.
+const maxFileChars = 200_000
+
+var textExtensions = []string{
+	".txt", ".md", ".markdown", ".log", ".csv", ".tsv", ".json", ".jsonl", ".yaml", ".yml", ".toml", ".ini", ".cfg", ".conf", ".env", ".xml", ".html", ".css", ".sql",
+	".go", ".py", ".js", ".ts", ".jsx", ".tsx", ".java", ".kt", ".c", ".h", ".cpp", ".hpp", ".cs", ".rs", ".rb", ".php", ".swift", ".sh", ".bash", ".ps1", ".lua", ".r", ".mdc",
+}
+
+var textContentTypes = []string{"application/json", "application/xml", "application/yaml", "application/x-yaml", "application/javascript", "application/x-sh", "application/sql"}
+
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif"}
+
+func isImageAttachment(attachment Attachment) bool {
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(attachment.Name))
+	for _, imageExt := range imageExtensions {
+		if ext == imageExt {
+			return true
+		}
+	}
+	return false
+}
+
+func isPDFAttachment(attachment Attachment) bool {
+	return strings.HasPrefix(attachment.ContentType, "application/pdf") || strings.ToLower(path.Ext(attachment.Name)) == ".pdf"
+}
+
+func isTextAttachment(attachment Attachment) bool {
+	contentType, _, _ := strings.Cut(attachment.ContentType, ";")
+	return strings.HasPrefix(contentType, "text/") || slices.Contains(textContentTypes, contentType) ||
+		slices.Contains(textExtensions, strings.ToLower(path.Ext(attachment.Name)))
+}
+
+// loadFiles downloads the text files and documents attached to a message, and extracts their text.
+// Files that cannot be loaded are described in the returned notes instead, so the agent can tell the user.
+func loadFiles(attachments []Attachment) ([]ai.File, []string) {
+	files := make([]ai.File, 0)
+	notes := make([]string, 0)
+	for _, attachment := range attachments {
+		if isImageAttachment(attachment) {
+			continue
+		}
+		isPDF := isPDFAttachment(attachment)
+		if !isPDF && !isTextAttachment(attachment) {
+			notes = append(notes, fmt.Sprintf("The file '%s' was attached, but you cannot read files of this type (only text files, source code and pdfs).", attachment.Name))
+			continue
+		}
+		if attachment.Size > maxFileBytes {
+			notes = append(notes, fmt.Sprintf("The file '%s' was not shown to you, as it is too large.", attachment.Name))
+			continue
+		}
+		content, err := attachment.Download()
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("The file '%s' could not be downloaded.", attachment.Name))
+			continue
+		}
+		var text string
+		if isPDF {
+			text, err = extractPDFText(content)
+			if err != nil {
+				notes = append(notes, fmt.Sprintf("No text could be read from the pdf '%s' (it may be scanned, or use an unusual encoding).", attachment.Name))
+				continue
+			}
+		} else {
+			if !utf8.Valid(content) {
+				notes = append(notes, fmt.Sprintf("The file '%s' was not shown to you, as it is not a text file.", attachment.Name))
+				continue
+			}
+			text = string(content)
+		}
+		if runes := []rune(text); len(runes) > maxFileChars {
+			text = string(runes[:maxFileChars]) + "\n[The rest of the file was cut off as it is too long]"
+		}
+		files = append(files, ai.File{Name: attachment.Name, Content: text})
+	}
+	return files, notes
+}
+
+// loadImages downloads and decodes the images attached to a message.
+// Images that cannot be loaded are described in the returned notes instead, so the agent can tell the user.
+func loadImages(attachments []Attachment) ([]ai.Image, []string) {
+	images := make([]ai.Image, 0)
+	notes := make([]string, 0)
+	for _, attachment := range attachments {
+		if !isImageAttachment(attachment) {
+			continue
+		}
+		if len(images) >= maxImagesPerMessage {
+			notes = append(notes, fmt.Sprintf("The image '%s' was not shown to you, as only %d images can be shown per message.", attachment.Name, maxImagesPerMessage))
+			continue
+		}
+		if attachment.Size > maxImageBytes {
+			notes = append(notes, fmt.Sprintf("The image '%s' was not shown to you, as it is too large.", attachment.Name))
+			continue
+		}
+		content, err := attachment.Download()
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("The image '%s' could not be downloaded.", attachment.Name))
+			continue
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(content))
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("The image '%s' was not shown to you, as it is not in a supported format (png, jpeg or gif).", attachment.Name))
+			continue
+		}
+		if len(content) > maxImageBytes || config.Width*config.Height > maxImagePixels {
+			notes = append(notes, fmt.Sprintf("The image '%s' was not shown to you, as it is too large.", attachment.Name))
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(content))
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("The image '%s' could not be read, as it is corrupt.", attachment.Name))
+			continue
+		}
+		images = append(images, ai.Image{Name: attachment.Name, Source: img})
+	}
+	return images, notes
+}
+
+// withAttachments adds the attachments of a message to the message for the agent.
+// This downloads the attachments, so it should only be done once the agent is definitely going to be run.
+func withAttachments(msg ai.Message, attachments []Attachment) ai.Message {
+	images, imageNotes := loadImages(attachments)
+	files, fileNotes := loadFiles(attachments)
+	msg.Images = images
+	msg.Files = files
+	for _, note := range append(imageNotes, fileNotes...) {
+		msg.Context = append(msg.Context, ai.MessageContext{Kind: "attachments", Content: note})
+	}
+	return msg
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"craig/data"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+func newMessageBatcher(policy data.BatchingPolicy) *messageBatcher {
+	return &messageBatcher{
+		policy:  policy,
+		batches: make(map[string]*messageBatch),
+	}
+}
+
+// messageBatcher collects the messages that one person sends to a conversation in quick succession, so that they can be answered with a single reply.
+// Only messages from the same person are batched, as the reply is worked on with the permissions of the person it answers.
+type messageBatcher struct {
+	policy  data.BatchingPolicy
+	lock    sync.Mutex
+	batches map[string]*messageBatch
+}
+
+// messageBatch is a set of messages that will be answered together.
+type messageBatch struct {
+	conversationID string
+	messages       []IncomingMessage
+	// The sink of each message, the reply is sent to the sink of the most recent one.
+	sinks []ReplySink
+	// When to stop waiting for another message and start answering.
+	deadline time.Time
+	// Incremented whenever a message is added, so that a reply to fewer messages can be recognised as stale.
+	generation int
+	// Whether the agent is working on a reply to the batch.
+	answering bool
+	// Closed once the batch has been answered.
+	done chan struct{}
+}
+
+// batchTurn is an attempt at answering the messages that were in a batch at one point.
+// A nil turn is never stale.
+type batchTurn struct {
+	batcher    *messageBatcher
+	batch      *messageBatch
+	generation int
+}
+
+func (b *messageBatcher) enabled() bool {
+	return b.policy.WindowMillis > 0 || b.policy.RestartInFlight
+}
+
+// join adds a message to the batch that is being collected or answered in its conversation, returning nil if there is no batch it can be added to.
+func (b *messageBatcher) join(msg IncomingMessage, sink ReplySink) *messageBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	batch, ok := b.batches[msg.Conversation.ID]
+	if !ok || !b.accepts(batch, msg) {
+		return nil
+	}
+	b.add(batch, msg, sink)
+	return batch
+}
+
+// start starts a new batch for a message, returning false if the message was instead added to a batch that was started in the meantime.
+func (b *messageBatcher) start(msg IncomingMessage, sink ReplySink) (*messageBatch, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if batch, ok := b.batches[msg.Conversation.ID]; ok && b.accepts(batch, msg) {
+		b.add(batch, msg, sink)
+		return batch, false
+	}
+	// Any batch that cannot accept the message carries on by itself, but later messages join the new batch.
+	batch := &messageBatch{conversationID: msg.Conversation.ID, done: make(chan struct{})}
+	b.add(batch, msg, sink)
+	b.batches[msg.Conversation.ID] = batch
+	return batch, true
+}
+
+// accepts checks whether a message can be added to a batch, b.lock must already be held.
+func (b *messageBatcher) accepts(batch *messageBatch, msg IncomingMessage) bool {
+	if batch.answering && !b.policy.RestartInFlight {
+		return false
+	}
+	return batch.messages[0].Author.ID == msg.Author.ID
+}
+
+// add adds a message to a batch, b.lock must already be held.
+func (b *messageBatcher) add(batch *messageBatch, msg IncomingMessage, sink ReplySink) {
+	batch.messages = append(batch.messages, msg)
+	batch.sinks = append(batch.sinks, sink)
+	batch.deadline = time.Now().Add(time.Duration(b.policy.WindowMillis) * time.Millisecond)
+	batch.generation++
+}
+
+// wait blocks until no message has been added to a batch for the window, then returns the messages to answer, their sinks, and the turn that answers them.
+func (b *messageBatcher) wait(batch *messageBatch) ([]IncomingMessage, []ReplySink, *batchTurn) {
+	for {
+		b.lock.Lock()
+		remaining := time.Until(batch.deadline)
+		if remaining <= 0 {
+			defer b.lock.Unlock()
+			batch.answering = true
+			return slices.Clone(batch.messages), slices.Clone(batch.sinks), &batchTurn{b, batch, batch.generation}
+		}
+		b.lock.Unlock()
+		time.Sleep(remaining)
+	}
+}
+
+// stale reports whether a message has been added to the batch since the turn started, in which case its reply should be abandoned.
+func (t *batchTurn) stale() bool {
+	if t == nil {
+		return false
+	}
+	t.batcher.lock.Lock()
+	defer t.batcher.lock.Unlock()
+	return t.batch.generation != t.generation
+}
+
+// finish closes the batch, so that later messages start a new one.
+// If the turn has become stale it returns false instead, and the batch stays open to be answered again.
+func (t *batchTurn) finish() bool {
+	if t == nil {
+		return true
+	}
+	t.batcher.lock.Lock()
+	defer t.batcher.lock.Unlock()
+	if t.batch.generation != t.generation {
+		t.batch.answering = false
+		return false
+	}
+	if t.batcher.batches[t.batch.conversationID] == t.batch {
+		delete(t.batcher.batches, t.batch.conversationID)
+	}
+	return true
+}
+
+// respondBatched answers a message along with any more messages that the same person sends soon after it.
+// If another message arrives while the reply is being worked on (and the policy allows it), the reply is abandoned and the agent starts again with every message.
+func (app *App) respondBatched(msg IncomingMessage, sink ReplySink) {
+	if !msg.Conversation.BatchReplies || !app.batcher.enabled() {
+		app.respond(msg, sink, nil)
+		return
+	}
+	batch, started := app.batcher.start(msg, sink)
+	if !started {
+		app.logger.Info("Message added to batch", "conversation", msg.Conversation.ID)
+		<-batch.done
+		return
+	}
+	defer close(batch.done)
+	for {
+		messages, sinks, turn := app.batcher.wait(batch)
+		sink := sinks[len(sinks)-1]
+		for i := range messages {
+			messages[i] = loadDetails(messages[i])
+		}
+		combined := combineMessages(messages)
+		if len(messages) > 1 {
+			app.logger.Info("Answering batch of messages", "conversation", combined.Conversation.ID, "messages", len(messages))
+		}
+		if app.respond(combined, sink, turn) {
+			app.answered(messages, sinks, sink)
+			return
+		}
+		app.logger.Info("Abandoned reply as more messages arrived", "conversation", combined.Conversation.ID)
+		// The agent will see the abandoned messages again, so it should forget its first attempt at answering them.
+		_, err := app.sessions.Retract(combined.Conversation.ID, combined.ID)
+		if err != nil {
+			app.logger.Error("Failed to remove abandoned reply", "err", err.Error())
+		}
+	}
+}
+
+// The number of messages whose batches are remembered, so that edits and deletes of older messages only affect the message itself.
+const maxAnsweredBatchMessages = 1000
+
+func newAnsweredBatches() *answeredBatches {
+	return &answeredBatches{batches: make(map[string][]IncomingMessage)}
+}
+
+// answeredBatches remembers the messages of recent batches that were answered together, by the id of each message,
+// so that an edit or delete of one of them can be answered along with the rest of its batch.
+type answeredBatches struct {
+	lock    sync.Mutex
+	batches map[string][]IncomingMessage
+	// The ids of the messages in batches, oldest first.
+	order []string
+}
+
+// record remembers the messages that were answered together, forgetting them if there was only one.
+func (a *answeredBatches) record(messages []IncomingMessage) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, msg := range messages {
+		if msg.ID == "" {
+			continue
+		}
+		if len(messages) < 2 {
+			a.removeLocked(msg.ID)
+			continue
+		}
+		if _, ok := a.batches[msg.ID]; !ok {
+			a.order = append(a.order, msg.ID)
+		}
+		a.batches[msg.ID] = slices.Clone(messages)
+	}
+	for len(a.order) > maxAnsweredBatchMessages {
+		delete(a.batches, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+// withEdit returns the batch that a message was answered in, with the message replaced by its edited version.
+// If the message was answered by itself, the batch is just the edited message.
+func (a *answeredBatches) withEdit(edited IncomingMessage) []IncomingMessage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	messages := slices.Clone(a.batches[edited.ID])
+	i := slices.IndexFunc(messages, func(msg IncomingMessage) bool { return msg.ID == edited.ID })
+	if i < 0 {
+		return []IncomingMessage{edited}
+	}
+	messages[i] = edited
+	return messages
+}
+
+// withoutDeleted forgets a deleted message, returning the rest of the batch it was answered in, or nil if it was answered by itself.
+func (a *answeredBatches) withoutDeleted(messageID string) []IncomingMessage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	messages := a.batches[messageID]
+	a.removeLocked(messageID)
+	return slices.DeleteFunc(slices.Clone(messages), func(msg IncomingMessage) bool { return msg.ID == messageID })
+}
+
+func (a *answeredBatches) removeLocked(messageID string) {
+	if _, ok := a.batches[messageID]; !ok {
+		return
+	}
+	delete(a.batches, messageID)
+	a.order = slices.DeleteFunc(a.order, func(id string) bool { return id == messageID })
+}
+
+// answered remembers messages that were answered together by a reply sent to replySink, and tells the sink of each message about the batch.
+func (app *App) answered(messages []IncomingMessage, sinks []ReplySink, replySink ReplySink) {
+	app.batches.record(messages)
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	for _, sink := range sinks {
+		if batchSink, ok := sink.(BatchReplySink); ok {
+			batchSink.AnsweredWith(replySink, ids)
+		}
+	}
+}
+
+// combineMessages merges messages from one person that are answered together into one message, which otherwise looks like the most recent of them.
+func combineMessages(messages []IncomingMessage) IncomingMessage {
+	combined := messages[len(messages)-1]
+	if len(messages) == 1 {
+		return combined
+	}
+	lines := make([]string, 0, len(messages))
+	combined.Attachments = nil
+	combined.ReplyChain = nil
+	for _, msg := range messages {
+		lines = append(lines, msg.Content)
+		combined.CombinedIDs = append(combined.CombinedIDs, msg.ID)
+		combined.Attachments = append(combined.Attachments, msg.Attachments...)
+		combined.MentionsAgent = combined.MentionsAgent || msg.MentionsAgent
+		combined.RepliesToAgent = combined.RepliesToAgent || msg.RepliesToAgent
+		if combined.ReplyChain == nil {
+			combined.ReplyChain = msg.ReplyChain
+		}
+	}
+	combined.Content = strings.Join(lines, "\n")
+	return combined
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"craig/ai"
+	"craig/data"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSessions stands in for the agent, replying to each message with its content.
+// If block is set, the first message is not answered until block is closed.
+type fakeSessions struct {
+	lock      sync.Mutex
+	sent      []ai.Message
+	retracted []string
+	started   chan struct{}
+	block     chan struct{}
+}
+
+func newFakeSessions(block bool) *fakeSessions {
+	s := &fakeSessions{started: make(chan struct{}, 10)}
+	if block {
+		s.block = make(chan struct{})
+	}
+	return s
+}
+
+func (s *fakeSessions) Send(conversationID string, msg ai.Message, stream ai.Stream) (ai.Reply, error) {
+	s.lock.Lock()
+	s.sent = append(s.sent, msg)
+	first := len(s.sent) == 1
+	s.lock.Unlock()
+	s.started <- struct{}{}
+	if first && s.block != nil {
+		<-s.block
+	}
+	if stream.OnBegin != nil {
+		stream.OnBegin()
+	}
+	return ai.Reply{Text: msg.Content}, nil
+}
+
+func (s *fakeSessions) Retract(conversationID string, messageID string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retracted = append(s.retracted, messageID)
+	return true, nil
+}
+
+func (s *fakeSessions) Reset(conversationID string, reason string) error {
+	return nil
+}
+
+func (s *fakeSessions) Status(conversationID string) (ai.SessionStatus, int) {
+	return ai.SessionStatus{}, 0
+}
+
+func (s *fakeSessions) EvictIdle() ([]string, error) {
+	return nil, nil
+}
+
+// fakeSink records the replies that are sent to it, whether a reply started streaming, and the batch its message was answered in.
+type fakeSink struct {
+	lock       sync.Mutex
+	replies    []string
+	streamed   int
+	cancelled  int
+	answeredBy ReplySink
+	batch      []string
+}
+
+func (s *fakeSink) Reply(content string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.replies = append(s.replies, content)
+	return nil
+}
+
+func (s *fakeSink) BeginStream() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streamed++
+}
+
+func (s *fakeSink) StreamText(text string) {}
+
+func (s *fakeSink) CancelStream() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancelled++
+}
+
+func (s *fakeSink) AnsweredWith(replySink ReplySink, messageIDs []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.answeredBy = replySink
+	s.batch = messageIDs
+}
+
+func (s *fakeSink) sentReplies() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Clone(s.replies)
+}
+
+func newTestApp(t *testing.T, sessions agentSessions, batching data.BatchingPolicy) *App {
+	t.Helper()
+	triggers, err := newTriggerPolicy(data.TriggerPolicy{Default: data.TriggerRule{Always: true}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		sessions: sessions,
+		triggers: triggers,
+		batcher:  newMessageBatcher(batching),
+		batches:  newAnsweredBatches(),
+	}
+}
+
+func testMessage(id string, authorID string, content string) IncomingMessage {
+	return IncomingMessage{
+		ID:           id,
+		Author:       Author{ID: authorID, Name: authorID},
+		Conversation: Conversation{ID: "conversation", BatchReplies: true},
+		Content:      content,
+	}
+}
+
+// handleAll handles messages at the same time, waiting for each to be added to a batch before handling the next, then waits for them all to be answered.
+func handleAll(t *testing.T, app *App, messages []IncomingMessage, sinks []ReplySink) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i, msg := range messages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.HandleMessage(msg, sinks[i])
+		}()
+		waitFor(t, func() bool { return batchedMessages(app) >= i+1 })
+	}
+	wg.Wait()
+}
+
+// batchedMessages counts the messages that have been added to batches that are still open.
+func batchedMessages(app *App) int {
+	app.batcher.lock.Lock()
+	defer app.batcher.lock.Unlock()
+	n := 0
+	for _, batch := range app.batcher.batches {
+		n += len(batch.messages)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchingAnswersQuickMessagesTogether(t *testing.T) {
+	sessions := newFakeSessions(false)
+	app := newTestApp(t, sessions, data.BatchingPolicy{WindowMillis: 200})
+	first, second := &fakeSink{}, &fakeSink{}
+	handleAll(t, app, []IncomingMessage{
+		testMessage("1", "alice", "how do I"),
+		testMessage("2", "alice", "bake bread?"),
+	}, []ReplySink{first, second})
+
+	if len(sessions.sent) != 1 {
+		t.Fatalf("agent was run %d times, want 1", len(sessions.sent))
+	}
+	if got := sessions.sent[0]; got.Content != "how do I\nbake bread?" || !slices.Equal(got.IDs, []string{"1", "2"}) {
+		t.Errorf("agent got %q with ids %v", got.Content, got.IDs)
+	}
+	if replies := first.sentReplies(); len(replies) != 0 {
+		t.Errorf("first message got replies %q, want none", replies)
+	}
+	if replies := second.sentReplies(); !slices.Equal(replies, []string{"how do I\nbake bread?"}) {
+		t.Errorf("second message got replies %q", replies)
+	}
+	for _, sink := range []*fakeSink{first, second} {
+		if sink.answeredBy != second || !slices.Equal(sink.batch, []string{"1", "2"}) {
+			t.Errorf("sink was told it was answered by %v with %v, want the second sink with both messages", sink.answeredBy, sink.batch)
+		}
+	}
+}
+
+// answerBatch answers two messages from one person together, returning the app and the agent.
+func answerBatch(t *testing.T) (*App, *fakeSessions) {
+	t.Helper()
+	sessions := newFakeSessions(false)
+	app := newTestApp(t, sessions, data.BatchingPolicy{WindowMillis: 200})
+	handleAll(t, app, []IncomingMessage{
+		testMessage("1", "alice", "how do I"),
+		testMessage("2", "alice", "bake bread?"),
+	}, []ReplySink{&fakeSink{}, &fakeSink{}})
+	return app, sessions
+}
+
+func TestEditingBatchedMessageAnswersWholeBatch(t *testing.T) {
+	app, sessions := answerBatch(t)
+	sink := &fakeSink{}
+	app.HandleEdit(testMessage("1", "alice", "how can I"), sink)
+
+	if !slices.Equal(sessions.retracted, []string{"1"}) {
+		t.Errorf("retracted %v, want the batch's turn", sessions.retracted)
+	}
+	if len(sessions.sent) != 2 {
+		t.Fatalf("agent was run %d times, want 2", len(sessions.sent))
+	}
+	if got := sessions.sent[1]; got.Content != "how can I\nbake bread?" || !slices.Equal(got.IDs, []string{"1", "2"}) {
+		t.Errorf("agent got %q with ids %v, want the whole batch with the edit", got.Content, got.IDs)
+	}
+	if replies := sink.sentReplies(); !slices.Equal(replies, []string{"how can I\nbake bread?"}) {
+		t.Errorf("got replies %q", replies)
+	}
+	if !slices.Equal(sink.batch, []string{"1", "2"}) {
+		t.Errorf("sink was told the reply answers %v, want both messages", sink.batch)
+	}
+
+	// A second edit builds on the first.
+	app.HandleEdit(testMessage("2", "alice", "bake cake?"), &fakeSink{})
+	if got := sessions.sent[2].Content; got != "how can I\nbake cake?" {
+		t.Errorf("agent got %q after a second edit", got)
+	}
+}
+
+func TestDeletingBatchedMessageAnswersRest(t *testing.T) {
+	app, sessions := answerBatch(t)
+	sink := &fakeSink{}
+	app.HandleDelete("conversation", "1", sink)
+
+	if !slices.Equal(sessions.retracted, []string{"1"}) {
+		t.Errorf("retracted %v, want the batch's turn", sessions.retracted)
+	}
+	if len(sessions.sent) != 2 {
+		t.Fatalf("agent was run %d times, want 2", len(sessions.sent))
+	}
+	if got := sessions.sent[1]; got.Content != "bake bread?" || !slices.Equal(got.IDs, []string{"2"}) {
+		t.Errorf("agent got %q with ids %v, want the rest of the batch", got.Content, got.IDs)
+	}
+	if replies := sink.sentReplies(); !slices.Equal(replies, []string{"bake bread?"}) {
+		t.Errorf("got replies %q", replies)
+	}
+
+	// The rest of the batch was answered by itself, so deleting it only removes it.
+	app.HandleDelete("conversation", "2", &fakeSink{})
+	if len(sessions.sent) != 2 {
+		t.Errorf("agent was run again after the last message of the batch was deleted")
+	}
+}
+
+func TestDeletingUnbatchedMessageOnlyRemovesIt(t *testing.T) {
+	sessions := newFakeSessions(false)
+	app := newTestApp(t, sessions, data.BatchingPolicy{WindowMillis: 1})
+	app.HandleMessage(testMessage("1", "alice", "hello"), &fakeSink{})
+	app.HandleDelete("conversation", "1", nil)
+
+	if !slices.Equal(sessions.retracted, []string{"1"}) {
+		t.Errorf("retracted %v", sessions.retracted)
+	}
+	if len(sessions.sent) != 1 {
+		t.Errorf("agent was run %d times, want 1", len(sessions.sent))
+	}
+}
+
+func TestBatchingRestartsInFlightReply(t *testing.T) {
+	sessions := newFakeSessions(true)
+	app := newTestApp(t, sessions, data.BatchingPolicy{RestartInFlight: true})
+	first, second := &fakeSink{}, &fakeSink{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		app.HandleMessage(testMessage("1", "alice", "how do I"), first)
+	}()
+	<-sessions.started
+	go func() {
+		defer wg.Done()
+		app.HandleMessage(testMessage("2", "alice", "bake bread?"), second)
+	}()
+	waitFor(t, func() bool { return batchedMessages(app) == 2 })
+	close(sessions.block)
+	wg.Wait()
+
+	if len(sessions.sent) != 2 {
+		t.Fatalf("agent was run %d times, want 2", len(sessions.sent))
+	}
+	if got := sessions.sent[1].Content; got != "how do I\nbake bread?" {
+		t.Errorf("agent was run again with %q, want both messages", got)
+	}
+	if !slices.Equal(sessions.retracted, []string{"1"}) {
+		t.Errorf("retracted %v, want the abandoned turn", sessions.retracted)
+	}
+	if replies := first.sentReplies(); len(replies) != 0 {
+		t.Errorf("abandoned reply was sent: %q", replies)
+	}
+	if first.streamed != 0 {
+		t.Error("abandoned reply was streamed")
+	}
+	if replies := second.sentReplies(); !slices.Equal(replies, []string{"how do I\nbake bread?"}) {
+		t.Errorf("got replies %q, want a single reply to both messages", replies)
+	}
+}
+
+func TestBatchingWithoutRestartAnswersLateMessageAfterwards(t *testing.T) {
+	sessions := newFakeSessions(true)
+	app := newTestApp(t, sessions, data.BatchingPolicy{WindowMillis: 1})
+	first, second := &fakeSink{}, &fakeSink{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		app.HandleMessage(testMessage("1", "alice", "how do I bake bread?"), first)
+	}()
+	<-sessions.started
+	go func() {
+		defer wg.Done()
+		app.HandleMessage(testMessage("2", "alice", "and cake?"), second)
+	}()
+	// The late message starts a turn of its own, rather than joining the one that is being answered.
+	<-sessions.started
+	close(sessions.block)
+	wg.Wait()
+
+	if len(sessions.retracted) != 0 {
+		t.Errorf("retracted %v, want nothing", sessions.retracted)
+	}
+	if replies := first.sentReplies(); !slices.Equal(replies, []string{"how do I bake bread?"}) {
+		t.Errorf("first message got replies %q", replies)
+	}
+	if replies := second.sentReplies(); !slices.Equal(replies, []string{"and cake?"}) {
+		t.Errorf("second message got replies %q", replies)
+	}
+}
+
+func TestBatchingKeepsPeopleApart(t *testing.T) {
+	sessions := newFakeSessions(false)
+	app := newTestApp(t, sessions, data.BatchingPolicy{WindowMillis: 200, RestartInFlight: true})
+	alice, bob := &fakeSink{}, &fakeSink{}
+	var wg sync.WaitGroup
+	for _, c := range []struct {
+		msg  IncomingMessage
+		sink *fakeSink
+	}{
+		{testMessage("1", "alice", "hello"), alice},
+		{testMessage("2", "bob", "hi"), bob},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.HandleMessage(c.msg, c.sink)
+		}()
+	}
+	wg.Wait()
+
+	if len(sessions.sent) != 2 {
+		t.Fatalf("agent was run %d times, want once for each person", len(sessions.sent))
+	}
+	for _, msg := range sessions.sent {
+		if strings.Contains(msg.Content, "\n") {
+			t.Errorf("messages from different people were combined: %q", msg.Content)
+		}
+	}
+	if !slices.Equal(alice.sentReplies(), []string{"hello"}) || !slices.Equal(bob.sentReplies(), []string{"hi"}) {
+		t.Errorf("got replies %q and %q", alice.sentReplies(), bob.sentReplies())
+	}
+}
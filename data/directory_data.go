@@ -2,12 +2,14 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/JoshPattman/react"
 	"github.com/adrg/frontmatter"
@@ -23,15 +25,19 @@ type DirectoryData struct {
 
 func (dd *DirectoryData) GetScratchPad() ScratchPad {
 	return &fileScratchPad{
-		path.Join(dd.root, "scratchpad.txt"),
+		filepath: path.Join(dd.root, "scratchpad.txt"),
 	}
 }
 
 type fileScratchPad struct {
+	// Sessions may use the scratch pad concurrently, so reads and rewrites are serialised.
+	lock     sync.Mutex
 	filepath string
 }
 
 func (s *fileScratchPad) Content() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	content, err := os.ReadFile(s.filepath)
 	if err != nil {
 		return "", err
@@ -40,6 +46,8 @@ func (s *fileScratchPad) Content() (string, error) {
 }
 
 func (s *fileScratchPad) Rewrite(oldText, newText string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	content, err := os.ReadFile(s.filepath)
 	if err != nil {
 		return err
@@ -52,8 +60,7 @@ func (s *fileScratchPad) Rewrite(oldText, newText string) error {
 		return ErrOldTextAmbiguous
 	}
 	newContent := strings.ReplaceAll(string(content), oldText, newText)
-	err = os.WriteFile(s.filepath, []byte(newContent), os.ModePerm)
-	return nil
+	return os.WriteFile(s.filepath, []byte(newContent), os.ModePerm)
 }
 
 func (dd *DirectoryData) GetSkillset() Skillset {
@@ -171,6 +178,94 @@ func (dd *DirectoryData) FilterModel() (ModelSetup, error) {
 	return loadModelSetup(path.Join(dd.root, "models", "filter.json"))
 }
 
+// SessionPolicy loads the session policy, falling back to the default policy if there is no policy file.
+func (dd *DirectoryData) SessionPolicy() (SessionPolicy, error) {
+	policy := SessionPolicy{
+		IdleTimeoutMinutes: 60,
+		Compaction: CompactionPolicy{
+			MaxMessages: 30,
+			MaxTokens:   12000,
+			WriteFacts:  true,
+		},
+		Batching: BatchingPolicy{
+			WindowMillis:    1500,
+			RestartInFlight: true,
+		},
+	}
+	err := loadOptionalJSON(path.Join(dd.root, "session.json"), &policy)
+	if err != nil {
+		return SessionPolicy{}, err
+	}
+	return policy, nil
+}
+
+// TriggerPolicy loads the trigger policy, falling back to the same rule as the default triggers.json if there is no policy file.
+func (dd *DirectoryData) TriggerPolicy() (TriggerPolicy, error) {
+	policy := TriggerPolicy{
+		Default: TriggerRule{
+			OnMention:           true,
+			OnReply:             true,
+			Keywords:            []string{"craig"},
+			ActiveWindowMinutes: 10,
+			FilterCheck:         true,
+		},
+	}
+	err := loadOptionalJSON(path.Join(dd.root, "triggers.json"), &policy)
+	if err != nil {
+		return TriggerPolicy{}, err
+	}
+	return policy, nil
+}
+
+// ThreadPolicy loads the thread policy, falling back to never starting threads if there is no policy file.
+func (dd *DirectoryData) ThreadPolicy() (ThreadPolicy, error) {
+	policy := ThreadPolicy{
+		Default: ThreadRule{AutoArchiveMinutes: 60},
+	}
+	err := loadOptionalJSON(path.Join(dd.root, "threads.json"), &policy)
+	if err != nil {
+		return ThreadPolicy{}, err
+	}
+	return policy, nil
+}
+
+// AccessPolicy loads the access policy, falling back to allowing everything if there is no policy file.
+func (dd *DirectoryData) AccessPolicy() (AccessPolicy, error) {
+	policy := AccessPolicy{
+		DefaultAllow: true,
+		AllowDMs:     true,
+	}
+	err := loadOptionalJSON(path.Join(dd.root, "access.json"), &policy)
+	if err != nil {
+		return AccessPolicy{}, err
+	}
+	return policy, nil
+}
+
+// ToolPermissions loads the tool permissions, falling back to allowing every tool for everyone if there is no permissions file.
+func (dd *DirectoryData) ToolPermissions() (ToolPermissions, error) {
+	permissions := ToolPermissions{
+		Default: ToolRule{Allow: []string{"*"}},
+	}
+	err := loadOptionalJSON(path.Join(dd.root, "permissions.json"), &permissions)
+	if err != nil {
+		return ToolPermissions{}, err
+	}
+	return permissions, nil
+}
+
+// loadOptionalJSON decodes a json file into a value, leaving the value untouched if the file does not exist.
+func loadOptionalJSON(fp string, into any) error {
+	f, err := os.Open(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(into)
+}
+
 func (dd *DirectoryData) Personality() (string, error) {
 	data, err := os.ReadFile(path.Join(dd.root, "personality.txt"))
 	if err != nil {
@@ -199,17 +294,71 @@ type mcpConfig struct {
 	Enabled bool              `json:"enabled"`
 }
 
+// MCPServer describes a configured MCP server, leaving out its headers as they may contain secrets.
+type MCPServer struct {
+	Name    string
+	URL     string
+	Enabled bool
+}
+
+// MCPServers lists the configured MCP servers, without connecting to them.
+func (dd *DirectoryData) MCPServers() ([]MCPServer, error) {
+	names, configs, err := dd.loadMCPConfigs()
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]MCPServer, len(configs))
+	for i, cfg := range configs {
+		servers[i] = MCPServer{Name: names[i], URL: cfg.URL, Enabled: cfg.Enabled}
+	}
+	return servers, nil
+}
+
 func (dd *DirectoryData) EnabledTools() ([]react.Tool, error) {
 	var allTools []react.Tool
 
+	names, configs, err := dd.loadMCPConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, cfg := range configs {
+		// Skip disabled servers
+		if !cfg.Enabled {
+			continue
+		}
+
+		// Connect MCP
+		mcp, err := connectMCP(cfg.URL, cfg.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect MCP %s: %w", cfg.URL, err)
+		}
+
+		// Convert MCP tools
+		mcpTools, err := createToolsFromMCP(mcp, names[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed creating tools from MCP %s: %w", cfg.URL, err)
+		}
+
+		// Add to global list
+		allTools = append(allTools, mcpTools...)
+	}
+
+	return allTools, nil
+}
+
+// loadMCPConfigs reads every MCP config, returning the names of the servers (the config file names) alongside their configs.
+func (dd *DirectoryData) loadMCPConfigs() ([]string, []mcpConfig, error) {
 	// Directory where MCP configs live
 	configDir := filepath.Join(dd.root, "mcp")
 
 	entries, err := os.ReadDir(configDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read mcp directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to read mcp directory: %w", err)
 	}
 
+	var names []string
+	var configs []mcpConfig
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
@@ -225,35 +374,18 @@ func (dd *DirectoryData) EnabledTools() ([]react.Tool, error) {
 		// Read file
 		data, err := os.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+			return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
 		}
 
 		// Parse JSON config
 		var cfg mcpConfig
 		if err := json.Unmarshal(data, &cfg); err != nil {
-			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+			return nil, nil, fmt.Errorf("failed to parse %s: %w", path, err)
 		}
 
-		// Skip disabled servers
-		if !cfg.Enabled {
-			continue
-		}
-
-		// Connect MCP
-		mcp, err := connectMCP(cfg.URL, cfg.Headers)
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect MCP %s: %w", cfg.URL, err)
-		}
-
-		// Convert MCP tools
-		mcpTools, err := createToolsFromMCP(mcp)
-		if err != nil {
-			return nil, fmt.Errorf("failed creating tools from MCP %s: %w", cfg.URL, err)
-		}
-
-		// Add to global list
-		allTools = append(allTools, mcpTools...)
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		configs = append(configs, cfg)
 	}
 
-	return allTools, nil
+	return names, configs, nil
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"errors"
+	"time"
 
 	"github.com/JoshPattman/react"
 )
@@ -26,6 +27,8 @@ type ModelSetup struct {
 	Headers         map[string]string `json:"headers"`
 	Temperature     *float64          `json:"temperature"`
 	ReasoningEffort *string           `json:"reasoning_effort"`
+	// Whether the model can see images, assumed to be true if not set.
+	Images *bool `json:"images"`
 }
 
 type Models interface {
@@ -33,6 +36,93 @@ type Models interface {
 	FilterModel() (ModelSetup, error)
 }
 
+type CompactionPolicy struct {
+	MaxMessages int  `json:"max_messages"`
+	MaxTokens   int  `json:"max_tokens"`
+	WriteFacts  bool `json:"write_facts"`
+}
+
+type SessionPolicy struct {
+	IdleTimeoutMinutes    int              `json:"idle_timeout_minutes"`
+	MaxTurns              int              `json:"max_turns"`
+	MaxAgeMinutes         int              `json:"max_age_minutes"`
+	ResetOnLocationChange bool             `json:"reset_on_location_change"`
+	Compaction            CompactionPolicy `json:"compaction"`
+	Batching              BatchingPolicy   `json:"batching"`
+}
+
+// BatchingPolicy controls how messages that one person sends in quick succession are answered together with a single reply.
+// Messages from different people are never answered together, as the reply is worked on with the tool permissions of one person.
+type BatchingPolicy struct {
+	// How long to wait for another message before answering, 0 answers straight away.
+	WindowMillis int `json:"window_ms"`
+	// Whether a reply that is being worked on is abandoned, and started again with every message, when another message from the same person arrives.
+	RestartInFlight bool `json:"restart_in_flight"`
+}
+
+type Sessions interface {
+	SessionPolicy() (SessionPolicy, error)
+}
+
+type TriggerRule struct {
+	Always              bool     `json:"always"`
+	OnMention           bool     `json:"on_mention"`
+	OnReply             bool     `json:"on_reply"`
+	Keywords            []string `json:"keywords"`
+	Patterns            []string `json:"patterns"`
+	ActiveWindowMinutes int      `json:"active_window_minutes"`
+	FilterCheck         bool     `json:"filter_check"`
+}
+
+type TriggerPolicy struct {
+	Default  TriggerRule            `json:"default"`
+	Channels map[string]TriggerRule `json:"channels"`
+}
+
+type Triggers interface {
+	TriggerPolicy() (TriggerPolicy, error)
+}
+
+type ThreadRule struct {
+	// Whether to start a thread for each new conversation, rather than replying in the channel.
+	StartThread bool `json:"start_thread"`
+	// How long a started thread can be inactive before it is archived.
+	AutoArchiveMinutes int `json:"auto_archive_minutes"`
+}
+
+type ThreadPolicy struct {
+	Default  ThreadRule            `json:"default"`
+	Channels map[string]ThreadRule `json:"channels"`
+}
+
+type Threads interface {
+	ThreadPolicy() (ThreadPolicy, error)
+}
+
+type AccessList struct {
+	Allowed []string `json:"allowed"`
+	Denied  []string `json:"denied"`
+}
+
+type ChannelAccess struct {
+	// Overrides whether the channel is allowed, if set.
+	Allow *bool      `json:"allow"`
+	Users AccessList `json:"users"`
+}
+
+type AccessPolicy struct {
+	DefaultAllow bool                     `json:"default_allow"`
+	AllowDMs     bool                     `json:"allow_dms"`
+	Guilds       AccessList               `json:"guilds"`
+	Channels     AccessList               `json:"channels"`
+	Users        AccessList               `json:"users"`
+	ChannelRules map[string]ChannelAccess `json:"channel_rules"`
+}
+
+type Access interface {
+	AccessPolicy() (AccessPolicy, error)
+}
+
 type Personality interface {
 	Personality() (string, error)
 }
@@ -40,3 +130,58 @@ type Personality interface {
 type Tools interface {
 	EnabledTools() ([]react.Tool, error)
 }
+
+// MCPTool is a tool that is provided by an MCP server.
+type MCPTool interface {
+	react.Tool
+	// The name of the MCP server config the tool came from.
+	Server() string
+}
+
+// ToolRule allows or denies tools by name.
+// "mcp:<server>" matches every tool from an MCP server, and "*" matches every tool.
+type ToolRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type ToolPermissions struct {
+	Default ToolRule            `json:"default"`
+	Roles   map[string]ToolRule `json:"roles"`
+	Users   map[string]ToolRule `json:"users"`
+}
+
+type Permissions interface {
+	ToolPermissions() (ToolPermissions, error)
+}
+
+const (
+	TranscriptUserMessage  = "user_message"
+	TranscriptNotification = "notification"
+	TranscriptToolCall     = "tool_call"
+	TranscriptReply        = "reply"
+	TranscriptSummary      = "summary"
+	TranscriptReset        = "reset"
+	// A retraction removes an earlier message (the one with the retracted message id), and everything that happened in reply to it, from the conversation.
+	TranscriptRetraction = "retraction"
+)
+
+type TranscriptEntry struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Author   string    `json:"author,omitempty"`
+	Location string    `json:"location,omitempty"`
+	Content  string    `json:"content"`
+	// The ids of the messages on their frontend, if it is a user message (which may combine several messages) or a retraction, and the frontend gave them.
+	MessageIDs []string `json:"message_ids,omitempty"`
+	// For summaries, how many messages had been sent and when the conversation started, as the entries these were worked out from are replaced by the summary.
+	Turns     int       `json:"turns,omitempty"`
+	StartedAt time.Time `json:"started_at,omitzero"`
+}
+
+type Transcripts interface {
+	Append(conversationID string, entries ...TranscriptEntry) error
+	Load(conversationID string) ([]TranscriptEntry, error)
+	// Replace discards a transcript, starting it again with the given entries.
+	Replace(conversationID string, entries ...TranscriptEntry) error
+}
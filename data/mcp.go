@@ -38,7 +38,7 @@ func connectMCP(addr string, customHeaders map[string]string) (*client.Client, e
 	return c, nil
 }
 
-func createToolsFromMCP(client *client.Client) ([]react.Tool, error) {
+func createToolsFromMCP(client *client.Client, server string) ([]react.Tool, error) {
 	ctx := context.Background()
 	result, err := client.ListTools(ctx, mcp.ListToolsRequest{})
 	if err != nil {
@@ -46,7 +46,7 @@ func createToolsFromMCP(client *client.Client) ([]react.Tool, error) {
 	}
 	tools := make([]react.Tool, len(result.Tools))
 	for i, mcpTool := range result.Tools {
-		agentTool, err := createTool(client, mcpTool)
+		agentTool, err := createTool(client, server, mcpTool)
 		if err != nil {
 			return nil, err
 		}
@@ -55,12 +55,13 @@ func createToolsFromMCP(client *client.Client) ([]react.Tool, error) {
 	return tools, nil
 }
 
-func createTool(client *client.Client, tool mcp.Tool) (react.Tool, error) {
-	return &mcpTool{client, tool}, nil
+func createTool(client *client.Client, server string, tool mcp.Tool) (react.Tool, error) {
+	return &mcpTool{client, server, tool}, nil
 }
 
 type mcpTool struct {
 	client *client.Client
+	server string
 	tool   mcp.Tool
 }
 
@@ -103,6 +104,11 @@ func (m *mcpTool) Description() []string {
 	return desc
 }
 
+// Server implements MCPTool.
+func (m *mcpTool) Server() string {
+	return m.server
+}
+
 // Name implements agent.Tool.
 func (m *mcpTool) Name() string {
 	return m.tool.Name
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+func (dd *DirectoryData) GetTranscripts() Transcripts {
+	return &jsonlTranscripts{
+		root: filepath.Join(dd.root, "conversations"),
+	}
+}
+
+// jsonlTranscripts stores each conversation as a file of newline-separated JSON entries.
+type jsonlTranscripts struct {
+	lock sync.Mutex
+	root string
+}
+
+func (t *jsonlTranscripts) path(conversationID string) string {
+	return filepath.Join(t.root, url.PathEscape(conversationID)+".jsonl")
+}
+
+func (t *jsonlTranscripts) Append(conversationID string, entries ...TranscriptEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := os.MkdirAll(t.root, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.path(conversationID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		err = enc.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *jsonlTranscripts) Load(conversationID string) ([]TranscriptEntry, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f, err := os.Open(t.path(conversationID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]TranscriptEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry TranscriptEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Replace writes the new transcript to a temporary file first, so the old one is kept if it cannot be written.
+func (t *jsonlTranscripts) Replace(conversationID string, entries ...TranscriptEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := os.MkdirAll(t.root, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(t.root, "replace-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		err = enc.Encode(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), t.path(conversationID))
+}
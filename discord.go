@@ -1,39 +1,354 @@
 package main
 
 import (
+	"craig/data"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-type Runnable interface {
-	OnMessageCreate(*discordgo.Session, *discordgo.MessageCreate)
-}
+var discordAttachmentClient = &http.Client{Timeout: 30 * time.Second}
 
-func NewSession(app Runnable, botToken string) (*discordgo.Session, error) {
+func NewDiscordFrontend(botToken string, showToolStatus bool, deleteReplies bool, access data.AccessPolicy, threads data.ThreadPolicy, logger *slog.Logger) (*DiscordFrontend, error) {
 	dg, err := discordgo.New("Bot " + botToken)
 	if err != nil {
 		return nil, err
 	}
-	dg.AddHandler(app.OnMessageCreate)
-	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuildMembers
-	return dg, nil
+	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuildMembers | discordgo.IntentsDirectMessages
+	return &DiscordFrontend{
+		session:        dg,
+		showToolStatus: showToolStatus,
+		deleteReplies:  deleteReplies,
+		replies:        newDiscordReplyLog(),
+		audience:       newDiscordAudienceCache(),
+		access:         newDiscordAccess(access),
+		threads:        threads,
+		logger:         logger,
+	}, nil
+}
+
+type DiscordFrontend struct {
+	session        *discordgo.Session
+	showToolStatus bool
+	// Whether the agent's reply is deleted when the message it replied to is deleted.
+	deleteReplies bool
+	replies       *discordReplyLog
+	audience      *discordAudienceCache
+	access        *discordAccess
+	threads       data.ThreadPolicy
+	logger        *slog.Logger
 }
 
-func RunSession(session *discordgo.Session, logger *slog.Logger) error {
-	err := session.Open()
+func (d *DiscordFrontend) Run(handler MessageHandler) error {
+	d.session.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		d.onMessageCreate(s, m, handler)
+	})
+	if editHandler, ok := handler.(EditHandler); ok {
+		d.session.AddHandler(func(s *discordgo.Session, m *discordgo.MessageUpdate) {
+			d.onMessageUpdate(s, m, editHandler)
+		})
+		d.session.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDelete) {
+			d.onMessageDelete(s, m, editHandler)
+		})
+	}
+	if adminHandler, ok := handler.(AdminHandler); ok {
+		d.session.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+			d.registerCommands(s)
+		})
+		d.session.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			d.onInteractionCreate(s, i, adminHandler)
+		})
+	}
+	err := d.session.Open()
 	if err != nil {
-		logger.Error("Failed to start session", "err", err.Error())
+		d.logger.Error("Failed to start session", "err", err.Error())
 		return err
 	}
-	defer session.Close()
-	logger.Info("Session is running")
+	defer d.session.Close()
+	d.logger.Info("Session is running")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-sc
-	logger.Info("Session has gracefully quit")
+	d.logger.Info("Session has gracefully quit")
 	return nil
 }
+
+func (d *DiscordFrontend) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate, handler MessageHandler) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+	msg, sink, ok := d.incomingMessage(s, m.Message)
+	if !ok {
+		return
+	}
+	handler.HandleMessage(msg, sink)
+	conversationID := msg.Conversation.ID
+	if threadID := sink.replySink().startedThread(); threadID != "" {
+		conversationID = threadID
+	}
+	d.replies.record(m.Message, conversationID, sink)
+}
+
+// incomingMessage converts a discord message into a message for the handler, along with a sink to reply to it with.
+// It returns false if the message should not be handled.
+func (d *DiscordFrontend) incomingMessage(s *discordgo.Session, m *discordgo.Message) (IncomingMessage, *discordReplySink, bool) {
+	sink := &discordReplySink{session: s, channelID: m.ChannelID, showStatus: d.showToolStatus, replyTo: m.SoftReference()}
+	channel, err := s.Channel(m.ChannelID)
+	if err != nil {
+		d.logger.Error("Failed to get channel", "err", err.Error())
+		return IncomingMessage{}, nil, false
+	}
+	if !d.access.allows(channel.GuildID, channel.ID, channel.ParentID, m.Author.ID) {
+		d.logger.Info("Ignoring message that is not allowed by the access policy", "guild", channel.GuildID, "channel", channel.ID, "user", m.Author.ID)
+		return IncomingMessage{}, nil, false
+	}
+	sendData, err := d.getMessageSendData(s, m, channel)
+	if err != nil {
+		d.logger.Error("Failed to get message send data", "err", err.Error())
+		sink.Reply(internalErrMessage)
+		return IncomingMessage{}, nil, false
+	}
+	conversation := Conversation{
+		ID:             m.ChannelID,
+		ParentID:       channel.ParentID,
+		StartedByAgent: channel.IsThread() && channel.OwnerID == s.State.User.ID,
+		Private:        sendData.dmRecipients != nil,
+		BatchReplies:   true,
+	}
+	if rule := d.threadRule(channel.ID); rule.StartThread && channel.GuildID != "" && !channel.IsThread() {
+		// The reply will go in a new thread. Until the agent answers, the message is still part of the channel's conversation.
+		sink.thread = newThreadStart(m, sendData.authorName, rule)
+	}
+	conversation.Location = sendData.LocationString()
+	conversation.Audience = sendData.audience
+	return IncomingMessage{
+		LoadDetails: d.detailsLoader(s, m, channel, sendData, sink),
+		ID:          m.ID,
+		Author: Author{
+			ID:    m.Author.ID,
+			Name:  sendData.authorName,
+			Roles: memberRoles(m.Member),
+		},
+		Conversation:   conversation,
+		Content:        m.Content,
+		MentionsAgent:  mentionsUser(m, s.State.User.ID),
+		RepliesToAgent: m.ReferencedMessage != nil && m.ReferencedMessage.Author != nil && m.ReferencedMessage.Author.ID == s.State.User.ID,
+		Attachments:    discordAttachments(m.Attachments),
+		Actions: &discordChannelActions{
+			session:            s,
+			channel:            channel,
+			messageID:          m.ID,
+			userID:             m.Author.ID,
+			access:             d.access,
+			autoArchiveMinutes: archiveDuration(d.threadRule(channel.ID).AutoArchiveMinutes),
+		},
+	}, sink, true
+}
+
+// detailsLoader returns a function that looks up the audience (for guild channels) and reply chain of a message.
+// These take several requests to discord, so are only looked up once the agent is going to be run, and then only once.
+// If the reply will start a thread, the message is moved into the thread's conversation at the same time.
+func (d *DiscordFrontend) detailsLoader(s *discordgo.Session, m *discordgo.Message, channel *discordgo.Channel, sendData messageSendData, sink *discordReplySink) func(*IncomingMessage) {
+	var once sync.Once
+	threadSendData := sendData
+	if sink.thread != nil {
+		threadSendData.threadName = sink.thread.name
+	}
+	audience := sendData.audience
+	var chain []QuotedMessage
+	return func(msg *IncomingMessage) {
+		once.Do(func() {
+			if sendData.guild != nil {
+				audience = d.channelAudience(s, sendData.guild, channel, sendData.parent)
+			}
+			chain = d.replyChain(s, m)
+		})
+		msg.Conversation.Audience = audience
+		msg.ReplyChain = chain
+		if sink.startsThread() {
+			// The thread has the same id as the message it is started from.
+			msg.Conversation.ID = m.ID
+			msg.Conversation.ParentID = channel.ID
+			msg.Conversation.Location = threadSendData.LocationString()
+		}
+	}
+}
+
+// How many messages up a reply chain are shown to the agent.
+const maxDiscordReplyChain = 3
+
+// replyChain follows the messages that a message replies to, the message it directly replies to first.
+// Discord includes the directly referenced message in the event, but any earlier messages in the chain must be fetched.
+func (d *DiscordFrontend) replyChain(s *discordgo.Session, m *discordgo.Message) []QuotedMessage {
+	var chain []QuotedMessage
+	referenced := m.ReferencedMessage
+	if referenced == nil && m.MessageReference != nil {
+		referenced = d.fetchReferencedMessage(s, m)
+	}
+	for referenced != nil {
+		chain = append(chain, quoteDiscordMessage(s, referenced))
+		if len(chain) == maxDiscordReplyChain {
+			break
+		}
+		next := referenced.ReferencedMessage
+		if next == nil && referenced.MessageReference != nil {
+			next = d.fetchReferencedMessage(s, referenced)
+		}
+		referenced = next
+	}
+	return chain
+}
+
+// fetchReferencedMessage gets the message that a message replies to, or nil if it cannot be fetched (for example, because it has been deleted).
+func (d *DiscordFrontend) fetchReferencedMessage(s *discordgo.Session, m *discordgo.Message) *discordgo.Message {
+	ref := m.MessageReference
+	if ref.Type != discordgo.MessageReferenceTypeDefault || ref.MessageID == "" {
+		// Forwards are not replies.
+		return nil
+	}
+	channelID := ref.ChannelID
+	if channelID == "" {
+		channelID = m.ChannelID
+	}
+	referenced, err := s.ChannelMessage(channelID, ref.MessageID)
+	if err != nil {
+		d.logger.Warn("Failed to get referenced message", "channel", channelID, "message", ref.MessageID, "err", err.Error())
+		return nil
+	}
+	return referenced
+}
+
+func quoteDiscordMessage(s *discordgo.Session, m *discordgo.Message) QuotedMessage {
+	quoted := QuotedMessage{Content: m.Content}
+	if m.Author != nil {
+		quoted.AuthorName = m.Author.DisplayName()
+		quoted.FromAgent = m.Author.ID == s.State.User.ID
+	}
+	if len(m.Attachments) > 0 {
+		names := make([]string, len(m.Attachments))
+		for i, attachment := range m.Attachments {
+			names[i] = attachment.Filename
+		}
+		quoted.Content += fmt.Sprintf(" [attached: %s]", strings.Join(names, ", "))
+	}
+	return quoted
+}
+
+func discordAttachments(attachments []*discordgo.MessageAttachment) []Attachment {
+	converted := make([]Attachment, len(attachments))
+	for i, attachment := range attachments {
+		url := attachment.URL
+		converted[i] = Attachment{
+			Name:        attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			Download: func() ([]byte, error) {
+				return downloadDiscordAttachment(url)
+			},
+		}
+	}
+	return converted
+}
+
+func downloadDiscordAttachment(url string) ([]byte, error) {
+	resp, err := discordAttachmentClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download attachment: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// memberRoles lists the role ids of a guild member, or nothing if the message was not sent in a guild.
+func memberRoles(member *discordgo.Member) []string {
+	if member == nil {
+		return nil
+	}
+	return member.Roles
+}
+
+func mentionsUser(m *discordgo.Message, userID string) bool {
+	for _, user := range m.Mentions {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+type messageSendData struct {
+	authorName  string
+	channelName string
+	guildName   string
+	// The name of the thread, if the message is in a thread (in which case channelName is the name of the thread's channel).
+	threadName string
+	// The names of the other people in the conversation, if it is a direct message.
+	dmRecipients []string
+	audience     Audience
+	// The guild and, for threads, the thread's channel (if it could be found), which are used to look up the audience of guild channels.
+	guild  *discordgo.Guild
+	parent *discordgo.Channel
+}
+
+func (d messageSendData) LocationString() string {
+	if d.dmRecipients != nil {
+		return fmt.Sprintf("Discord(private dm with '%s')", strings.Join(d.dmRecipients, "', '"))
+	}
+	if d.threadName != "" {
+		return fmt.Sprintf("Discord(server='%s', channel='%s', thread='%s')", d.guildName, d.channelName, d.threadName)
+	}
+	return fmt.Sprintf("Discord(server='%s', channel='%s')", d.guildName, d.channelName)
+}
+
+func (d *DiscordFrontend) getMessageSendData(s *discordgo.Session, m *discordgo.Message, channel *discordgo.Channel) (messageSendData, error) {
+	name := m.Author.DisplayName()
+	if channel.Type == discordgo.ChannelTypeDM || channel.Type == discordgo.ChannelTypeGroupDM {
+		recipients := make([]string, 0, len(channel.Recipients))
+		for _, user := range channel.Recipients {
+			recipients = append(recipients, user.DisplayName())
+		}
+		if len(recipients) == 0 {
+			recipients = append(recipients, name)
+		}
+		return messageSendData{
+			authorName:   name,
+			channelName:  channel.Name,
+			dmRecipients: recipients,
+			audience:     Audience{Members: len(recipients) + 1},
+		}, nil
+	}
+	guild, err := s.GuildWithCounts(channel.GuildID)
+	if err != nil {
+		d.logger.Error("Failed to get guild", "err", err.Error())
+		return messageSendData{}, err
+	}
+	sendData := messageSendData{
+		authorName:  name,
+		channelName: channel.Name,
+		guildName:   guild.Name,
+		guild:       guild,
+	}
+	if channel.IsThread() {
+		sendData.threadName = channel.Name
+		parent, err := s.Channel(channel.ParentID)
+		if err != nil {
+			d.logger.Warn("Failed to get parent channel", "err", err.Error())
+		} else {
+			sendData.channelName = parent.Name
+			sendData.parent = parent
+		}
+	}
+	return sendData, nil
+}
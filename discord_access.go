@@ -0,0 +1,76 @@
+package main
+
+import (
+	"craig/data"
+	"slices"
+)
+
+func newDiscordAccess(policy data.AccessPolicy) *discordAccess {
+	return &discordAccess{policy: policy}
+}
+
+// discordAccess decides which guilds, channels and users the agent will respond to.
+type discordAccess struct {
+	policy data.AccessPolicy
+}
+
+// allows checks whether a message from a user in a channel may be handled.
+// For threads, parentID is the ID of the parent channel, and rules for the parent channel also apply to the thread.
+// For direct messages, guildID is empty.
+func (a *discordAccess) allows(guildID, channelID, parentID, userID string) bool {
+	p := a.policy
+	if listDenies(p.Users, userID) {
+		return false
+	}
+
+	channelIDs := []string{channelID}
+	if parentID != "" {
+		channelIDs = append(channelIDs, parentID)
+	}
+	// Rules for the channel itself take priority over rules for its parent.
+	for _, id := range channelIDs {
+		rule, ok := p.ChannelRules[id]
+		if !ok {
+			continue
+		}
+		// A channel that is turned off is off for everyone, even the users it lists.
+		if rule.Allow != nil && !*rule.Allow {
+			return false
+		}
+		if listDenies(rule.Users, userID) {
+			return false
+		}
+		if len(rule.Users.Allowed) > 0 {
+			return slices.Contains(rule.Users.Allowed, userID)
+		}
+		if rule.Allow != nil {
+			return listAllows(p.Users, userID)
+		}
+	}
+
+	if guildID == "" {
+		return p.AllowDMs && listAllows(p.Users, userID)
+	}
+	if listDenies(p.Guilds, guildID) || slices.ContainsFunc(channelIDs, func(id string) bool { return listDenies(p.Channels, id) }) {
+		return false
+	}
+	allowed := p.DefaultAllow
+	if slices.ContainsFunc(channelIDs, func(id string) bool { return slices.Contains(p.Channels.Allowed, id) }) ||
+		slices.Contains(p.Guilds.Allowed, guildID) {
+		allowed = true
+	}
+	return allowed && listAllows(p.Users, userID)
+}
+
+// listDenies checks whether an ID is explicitly denied.
+func listDenies(list data.AccessList, id string) bool {
+	return slices.Contains(list.Denied, id)
+}
+
+// listAllows checks whether an ID is allowed. An empty allow list allows everything.
+func listAllows(list data.AccessList, id string) bool {
+	if len(list.Allowed) == 0 {
+		return true
+	}
+	return slices.Contains(list.Allowed, id)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"craig/data"
+	"testing"
+)
+
+func TestDiscordAccessAllows(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name   string
+		policy data.AccessPolicy
+		// A guild id of "" is a DM, and a parent id is only set for threads.
+		guildID, channelID, parentID, userID string
+		want                                 bool
+	}{
+		{
+			name:    "default allow",
+			policy:  data.AccessPolicy{DefaultAllow: true},
+			guildID: "g", channelID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name:    "default deny",
+			policy:  data.AccessPolicy{},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name:    "allowed guild",
+			policy:  data.AccessPolicy{Guilds: data.AccessList{Allowed: []string{"g"}}},
+			guildID: "g", channelID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name:    "allowed channel",
+			policy:  data.AccessPolicy{Channels: data.AccessList{Allowed: []string{"c"}}},
+			guildID: "g", channelID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name:    "thread of allowed channel",
+			policy:  data.AccessPolicy{Channels: data.AccessList{Allowed: []string{"c"}}},
+			guildID: "g", channelID: "t", parentID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name:    "denied guild",
+			policy:  data.AccessPolicy{DefaultAllow: true, Guilds: data.AccessList{Denied: []string{"g"}}},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "denied channel in allowed guild",
+			policy: data.AccessPolicy{
+				Guilds:   data.AccessList{Allowed: []string{"g"}},
+				Channels: data.AccessList{Denied: []string{"c"}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name:    "thread of denied channel",
+			policy:  data.AccessPolicy{DefaultAllow: true, Channels: data.AccessList{Denied: []string{"c"}}},
+			guildID: "g", channelID: "t", parentID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name:    "denied user",
+			policy:  data.AccessPolicy{DefaultAllow: true, AllowDMs: true, Users: data.AccessList{Denied: []string{"u"}}},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name:    "user not in allow list",
+			policy:  data.AccessPolicy{DefaultAllow: true, Users: data.AccessList{Allowed: []string{"other"}}},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name:      "DMs allowed",
+			policy:    data.AccessPolicy{AllowDMs: true},
+			channelID: "dm", userID: "u",
+			want: true,
+		},
+		{
+			name:      "DMs not allowed",
+			policy:    data.AccessPolicy{DefaultAllow: true},
+			channelID: "dm", userID: "u",
+			want: false,
+		},
+		{
+			name:      "DMs from denied user",
+			policy:    data.AccessPolicy{AllowDMs: true, Users: data.AccessList{Denied: []string{"u"}}},
+			channelID: "dm", userID: "u",
+			want: false,
+		},
+		{
+			name: "channel rule turns on a channel",
+			policy: data.AccessPolicy{
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &on}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name: "channel rule turns off a channel in an allowed guild",
+			policy: data.AccessPolicy{
+				Guilds:       data.AccessList{Allowed: []string{"g"}},
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &off}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "channel turned off is off for its listed users",
+			policy: data.AccessPolicy{
+				DefaultAllow: true,
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &off, Users: data.AccessList{Allowed: []string{"u"}}}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "channel user list admits a listed user",
+			policy: data.AccessPolicy{
+				ChannelRules: map[string]data.ChannelAccess{"c": {Users: data.AccessList{Allowed: []string{"u"}}}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name: "channel user list refuses other users",
+			policy: data.AccessPolicy{
+				DefaultAllow: true,
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &on, Users: data.AccessList{Allowed: []string{"other"}}}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "channel user deny list",
+			policy: data.AccessPolicy{
+				DefaultAllow: true,
+				ChannelRules: map[string]data.ChannelAccess{"c": {Users: data.AccessList{Denied: []string{"u"}}}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "thread rule takes priority over its channel's rule",
+			policy: data.AccessPolicy{
+				ChannelRules: map[string]data.ChannelAccess{"t": {Allow: &on}, "c": {Allow: &off}},
+			},
+			guildID: "g", channelID: "t", parentID: "c", userID: "u",
+			want: true,
+		},
+		{
+			name: "thread follows its channel's rule",
+			policy: data.AccessPolicy{
+				DefaultAllow: true,
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &off}},
+			},
+			guildID: "g", channelID: "t", parentID: "c", userID: "u",
+			want: false,
+		},
+		{
+			name: "channel rule does not admit a globally denied user",
+			policy: data.AccessPolicy{
+				Users:        data.AccessList{Denied: []string{"u"}},
+				ChannelRules: map[string]data.ChannelAccess{"c": {Allow: &on, Users: data.AccessList{Allowed: []string{"u"}}}},
+			},
+			guildID: "g", channelID: "c", userID: "u",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newDiscordAccess(tt.policy).allows(tt.guildID, tt.channelID, tt.parentID, tt.userID)
+			if got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscordAccessWithoutPolicyFile(t *testing.T) {
+	policy, err := data.NewDirectoryData(t.TempDir()).AccessPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := newDiscordAccess(policy)
+	if !access.allows("g", "c", "", "u") {
+		t.Error("guild channels should be allowed without an access.json")
+	}
+	if !access.allows("", "dm", "", "u") {
+		t.Error("DMs should be allowed without an access.json")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"craig/ai/tools"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The number of messages that are searched when looking for the agent's most recent message.
+const discordOwnMessageSearchLimit = 50
+
+// History is fetched in pages of this many messages, and at most this many pages are fetched for a single query.
+const (
+	discordHistoryPageSize = 100
+	discordMaxHistoryPages = 10
+)
+
+// Messages read from the history are cut down to this many characters.
+const discordMaxHistoryMessageChars = 1000
+
+// Discord ids encode the time they were created, in milliseconds since this time.
+const discordEpochMillis = 1420070400000
+
+// discordChannelActions performs actions in the channel a message was sent in.
+// Actions are always done in that channel, so the agent cannot affect other channels.
+type discordChannelActions struct {
+	session   *discordgo.Session
+	channel   *discordgo.Channel
+	messageID string
+	// The person who sent the message, whose permissions limit what the agent can read.
+	userID string
+	access *discordAccess
+	// How long threads created by the agent can be inactive before they are archived.
+	autoArchiveMinutes int
+}
+
+func (a *discordChannelActions) React(messageID string, emoji string) error {
+	if messageID == "" {
+		messageID = a.messageID
+	}
+	return a.session.MessageReactionAdd(a.channel.ID, messageID, reactionEmoji(emoji))
+}
+
+// Custom emoji are written in messages as <:name:id>, or <a:name:id> if they are animated.
+var customEmojiPattern = regexp.MustCompile(`^<a?:(\w+):(\d+)>$`)
+
+// reactionEmoji converts an emoji into the form discord expects when reacting, which is name:id for custom emoji.
+func reactionEmoji(emoji string) string {
+	emoji = strings.TrimSpace(emoji)
+	if match := customEmojiPattern.FindStringSubmatch(emoji); match != nil {
+		return match[1] + ":" + match[2]
+	}
+	return emoji
+}
+
+func (a *discordChannelActions) Pin(messageID string) error {
+	if messageID == "" {
+		messageID = a.messageID
+	}
+	return a.session.ChannelMessagePin(a.channel.ID, messageID)
+}
+
+func (a *discordChannelActions) EditOwnMessage(messageID string, content string) error {
+	msg, err := a.ownMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if len([]rune(content)) > discordMessageLimit {
+		return fmt.Errorf("messages can be at most %d characters", discordMessageLimit)
+	}
+	_, err = a.session.ChannelMessageEdit(a.channel.ID, msg.ID, content)
+	return err
+}
+
+func (a *discordChannelActions) DeleteOwnMessage(messageID string) error {
+	msg, err := a.ownMessage(messageID)
+	if err != nil {
+		return err
+	}
+	return a.session.ChannelMessageDelete(a.channel.ID, msg.ID)
+}
+
+func (a *discordChannelActions) CreateThread(name string, messageID string) (string, error) {
+	if a.channel.IsThread() {
+		return "", errors.New("threads cannot be created inside a thread")
+	}
+	if a.channel.GuildID == "" {
+		return "", errors.New("threads cannot be created in direct messages")
+	}
+	name = threadName(name, "")
+	var thread *discordgo.Channel
+	var err error
+	if messageID != "" {
+		thread, err = a.session.MessageThreadStart(a.channel.ID, messageID, name, a.autoArchiveMinutes)
+	} else {
+		thread, err = a.session.ThreadStart(a.channel.ID, name, discordgo.ChannelTypeGuildPublicThread, a.autoArchiveMinutes)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("'%s' (link it with <#%s>)", thread.Name, thread.ID), nil
+}
+
+// ownMessage finds one of the agent's messages in the channel, or its most recent message before the message being replied to if messageID is empty.
+func (a *discordChannelActions) ownMessage(messageID string) (*discordgo.Message, error) {
+	botID := a.session.State.User.ID
+	if messageID != "" {
+		msg, err := a.session.ChannelMessage(a.channel.ID, messageID)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Author == nil || msg.Author.ID != botID {
+			return nil, errors.New("you can only change your own messages")
+		}
+		return msg, nil
+	}
+	messages, err := a.session.ChannelMessages(a.channel.ID, discordOwnMessageSearchLimit, a.messageID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if msg.Author != nil && msg.Author.ID == botID {
+			return msg, nil
+		}
+	}
+	return nil, errors.New("you have not sent any recent messages in this channel")
+}
+
+func (a *discordChannelActions) ReadHistory(query tools.HistoryQuery) ([]tools.HistoryMessage, error) {
+	channel := a.channel
+	if query.Parent {
+		if !channel.IsThread() {
+			return nil, errors.New("you are not in a thread")
+		}
+		parent, err := a.session.Channel(channel.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		channel = parent
+	}
+	// Messages must not be shown from channels the agent is not allowed in, or that the person asking cannot read.
+	if !a.access.allows(channel.GuildID, channel.ID, channel.ParentID, a.userID) {
+		return nil, errors.New("you are not allowed to read the history of this channel")
+	}
+	if channel.GuildID != "" {
+		// Threads take their permissions from their channel.
+		permissionChannelID := channel.ID
+		if channel.IsThread() {
+			permissionChannelID = channel.ParentID
+		}
+		permissions, err := a.session.UserChannelPermissions(a.userID, permissionChannelID)
+		if err != nil {
+			return nil, err
+		}
+		required := int64(discordgo.PermissionViewChannel | discordgo.PermissionReadMessageHistory)
+		if permissions&required != required {
+			return nil, errors.New("the person you are talking to cannot read the history of this channel")
+		}
+	}
+
+	before := ""
+	if !query.Before.IsZero() {
+		before = strconv.FormatInt((query.Before.UnixMilli()-discordEpochMillis)<<22, 10)
+	}
+	author := strings.ToLower(query.Author)
+	matched := make([]tools.HistoryMessage, 0)
+	for page := 0; page < discordMaxHistoryPages && len(matched) < query.Limit; page++ {
+		messages, err := a.session.ChannelMessages(channel.ID, discordHistoryPageSize, before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		done := len(messages) < discordHistoryPageSize
+		// Messages are newest first.
+		for _, msg := range messages {
+			if !query.After.IsZero() && msg.Timestamp.Before(query.After) {
+				done = true
+				break
+			}
+			if msg.Author == nil || !strings.Contains(strings.ToLower(msg.Author.DisplayName()), author) {
+				continue
+			}
+			matched = append(matched, discordHistoryMessage(msg, a.session.State.User.ID))
+			if len(matched) >= query.Limit {
+				break
+			}
+		}
+		if done || len(messages) == 0 {
+			break
+		}
+		before = messages[len(messages)-1].ID
+	}
+	slices.Reverse(matched)
+	return matched, nil
+}
+
+func discordHistoryMessage(msg *discordgo.Message, botID string) tools.HistoryMessage {
+	content := msg.Content
+	if runes := []rune(content); len(runes) > discordMaxHistoryMessageChars {
+		content = string(runes[:discordMaxHistoryMessageChars-1]) + "…"
+	}
+	attachments := make([]string, len(msg.Attachments))
+	for i, attachment := range msg.Attachments {
+		attachments[i] = attachment.Filename
+	}
+	return tools.HistoryMessage{
+		ID:          msg.ID,
+		Time:        msg.Timestamp,
+		Author:      msg.Author.DisplayName(),
+		Content:     content,
+		Attachments: attachments,
+		FromAgent:   msg.Author.ID == botID,
+	}
+}
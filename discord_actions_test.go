@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestReactionEmoji(t *testing.T) {
+	cases := map[string]string{
+		"👍":                    "👍",
+		"<:craig:123456789>":   "craig:123456789",
+		"<a:dance:987654321>":  "dance:987654321",
+		" <:craig:123456789> ": "craig:123456789",
+		"craig:123456789":      "craig:123456789",
+		"<:not an emoji:123>":  "<:not an emoji:123>",
+	}
+	for emoji, want := range cases {
+		if got := reactionEmoji(emoji); got != want {
+			t.Errorf("reactionEmoji(%q) = %q, want %q", emoji, got, want)
+		}
+	}
+}
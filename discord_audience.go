@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Working out who can see a channel means listing every member of the guild, so the result is cached for this long.
+const discordVisibleMembersCacheTTL = 10 * time.Minute
+
+// Guilds with more members than this are not listed, and the approximate member count of the guild is used instead.
+const discordMaxListedMembers = 5000
+
+// People who have sent a message within this long are counted as recently active.
+const discordActivityWindow = 30 * time.Minute
+
+// The number of recent messages that are checked when finding recently active people.
+const discordActivityMessages = 50
+
+func newDiscordAudienceCache() *discordAudienceCache {
+	return &discordAudienceCache{
+		visibleMembers: make(map[string]cachedMemberCount),
+	}
+}
+
+// discordAudienceCache caches the number of members who can see each channel.
+type discordAudienceCache struct {
+	lock           sync.Mutex
+	visibleMembers map[string]cachedMemberCount
+}
+
+type cachedMemberCount struct {
+	count   int
+	expires time.Time
+}
+
+// channelAudience works out who can see a guild channel (or thread), and who is taking part in it.
+// For threads, parent is the thread's channel, or nil if it could not be found.
+// Any part of the audience that cannot be worked out is left empty.
+func (d *DiscordFrontend) channelAudience(s *discordgo.Session, guild *discordgo.Guild, channel *discordgo.Channel, parent *discordgo.Channel) Audience {
+	audience := Audience{}
+
+	// Threads are visible to whoever can see their parent channel.
+	permissionChannel := channel
+	if channel.IsThread() {
+		permissionChannel = parent
+	}
+	if permissionChannel != nil {
+		count, err := d.visibleMemberCount(s, guild, permissionChannel)
+		if err != nil {
+			d.logger.Warn("Failed to count visible members", "err", err.Error())
+			count = guild.ApproximateMemberCount
+		}
+		audience.Members = count
+	}
+
+	active, err := recentlyActiveParticipants(s, channel.ID)
+	if err != nil {
+		d.logger.Warn("Failed to find recently active participants", "err", err.Error())
+	} else {
+		audience.ActiveParticipants = active
+	}
+
+	if channel.IsThread() {
+		members, err := threadMemberNames(s, channel.ID)
+		if err != nil {
+			d.logger.Warn("Failed to get thread members", "err", err.Error())
+		} else {
+			audience.ThreadMembers = members
+		}
+	}
+	return audience
+}
+
+// visibleMemberCount counts the people (not including bots) who can view a channel, plus one for the agent.
+func (d *DiscordFrontend) visibleMemberCount(s *discordgo.Session, guild *discordgo.Guild, channel *discordgo.Channel) (int, error) {
+	d.audience.lock.Lock()
+	cached, ok := d.audience.visibleMembers[channel.ID]
+	d.audience.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.count, nil
+	}
+
+	if guild.ApproximateMemberCount > discordMaxListedMembers {
+		return guild.ApproximateMemberCount, nil
+	}
+	count := 1
+	after := ""
+	for {
+		members, err := s.GuildMembers(guild.ID, after, 1000)
+		if err != nil {
+			return 0, err
+		}
+		for _, member := range members {
+			if member.User == nil || member.User.Bot {
+				continue
+			}
+			if canViewChannel(guild, channel, member) {
+				count++
+			}
+		}
+		if len(members) < 1000 {
+			break
+		}
+		after = members[len(members)-1].User.ID
+	}
+
+	d.audience.lock.Lock()
+	d.audience.visibleMembers[channel.ID] = cachedMemberCount{count, time.Now().Add(discordVisibleMembersCacheTTL)}
+	d.audience.lock.Unlock()
+	return count, nil
+}
+
+// canViewChannel checks whether a member is allowed to view a channel, taking the channel's permission overwrites into account.
+func canViewChannel(guild *discordgo.Guild, channel *discordgo.Channel, member *discordgo.Member) bool {
+	if member.User.ID == guild.OwnerID {
+		return true
+	}
+	var permissions int64
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID {
+			permissions |= role.Permissions
+		}
+		for _, roleID := range member.Roles {
+			if role.ID == roleID {
+				permissions |= role.Permissions
+			}
+		}
+	}
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return true
+	}
+
+	// Overwrites apply in order: @everyone, then roles, then the member.
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.ID == guild.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+		}
+	}
+	var denies, allows int64
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type != discordgo.PermissionOverwriteTypeRole {
+			continue
+		}
+		for _, roleID := range member.Roles {
+			if overwrite.ID == roleID {
+				denies |= overwrite.Deny
+				allows |= overwrite.Allow
+			}
+		}
+	}
+	permissions &^= denies
+	permissions |= allows
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == discordgo.PermissionOverwriteTypeMember && overwrite.ID == member.User.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+		}
+	}
+	return permissions&discordgo.PermissionViewChannel != 0
+}
+
+// recentlyActiveParticipants lists the people (not including bots) who have sent messages in a channel recently, most recent first.
+func recentlyActiveParticipants(s *discordgo.Session, channelID string) ([]string, error) {
+	messages, err := s.ChannelMessages(channelID, discordActivityMessages, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, msg := range messages {
+		if msg.Author == nil || msg.Author.Bot || time.Since(msg.Timestamp) > discordActivityWindow || seen[msg.Author.ID] {
+			continue
+		}
+		seen[msg.Author.ID] = true
+		names = append(names, msg.Author.DisplayName())
+	}
+	return names, nil
+}
+
+// threadMemberNames lists the people (not including bots) who have joined a thread.
+func threadMemberNames(s *discordgo.Session, threadID string) ([]string, error) {
+	members, err := s.ThreadMembers(threadID, 100, true, "")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		if member.Member == nil || member.Member.User == nil || member.Member.User.Bot {
+			continue
+		}
+		names = append(names, member.Member.DisplayName())
+	}
+	return names, nil
+}
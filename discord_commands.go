@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// By default, only people who can manage the server can use the commands. Server admins can change this in the integration settings.
+var discordCommandPermissions int64 = discordgo.PermissionManageGuild
+
+var discordCommands = []*discordgo.ApplicationCommand{
+	{
+		Name:                     "craig",
+		Description:              "Administer Craig",
+		DefaultMemberPermissions: &discordCommandPermissions,
+		// The commands can show the scratchpad, so they are not offered in dms where the permissions above do not apply.
+		Contexts: &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "reset",
+				Description: "Make Craig forget the conversation in this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "status",
+				Description: "Show the state of the conversation in this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "model",
+				Description: "Show the models Craig uses",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "scratchpad",
+				Description: "Craig's scratchpad",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show Craig's scratchpad",
+				}},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "skills",
+				Description: "Craig's skills",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List Craig's skills",
+				}},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+				Name:        "mcp",
+				Description: "Craig's MCP servers",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List Craig's MCP servers",
+				}},
+			},
+		},
+	},
+}
+
+func (d *DiscordFrontend) registerCommands(s *discordgo.Session) {
+	_, err := s.ApplicationCommandBulkOverwrite(s.State.User.ID, "", discordCommands)
+	if err != nil {
+		d.logger.Error("Failed to register commands", "err", err.Error())
+		return
+	}
+	d.logger.Info("Registered commands")
+}
+
+func (d *DiscordFrontend) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate, handler AdminHandler) {
+	if i.Type != discordgo.InteractionApplicationCommand || i.ApplicationCommandData().Name != "craig" {
+		return
+	}
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	channel, err := s.Channel(i.ChannelID)
+	if err != nil {
+		d.logger.Error("Failed to get channel", "err", err.Error())
+		return
+	}
+	if !d.access.allows(channel.GuildID, channel.ID, channel.ParentID, user.ID) {
+		d.logger.Info("Ignoring command that is not allowed by the access policy", "guild", channel.GuildID, "channel", channel.ID, "user", user.ID)
+		respondToCommand(s, i, "I do not respond in this channel")
+		return
+	}
+
+	// Some commands (such as waiting for a conversation to finish before resetting it) can take longer than discord allows for a response.
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		d.logger.Error("Failed to acknowledge command", "err", err.Error())
+		return
+	}
+
+	command := commandPath(i.ApplicationCommandData().Options)
+	d.logger.Info("Command received", "from", user.DisplayName(), "command", command)
+	content, err := runAdminCommand(handler, command, i.ChannelID, user.DisplayName())
+	if err != nil {
+		d.logger.Error("Failed to run command", "command", command, "err", err.Error())
+		content = internalErrMessage
+	}
+	edit := &discordgo.WebhookEdit{Content: &content}
+	if len(content) > discordMessageLimit {
+		note := discordReplyAttachmentNote
+		edit.Content = &note
+		edit.Files = []*discordgo.File{{
+			Name:        discordReplyAttachmentName,
+			ContentType: "text/markdown",
+			Reader:      strings.NewReader(content),
+		}}
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, edit)
+	if err != nil {
+		d.logger.Error("Failed to respond to command", "err", err.Error())
+	}
+}
+
+func runAdminCommand(handler AdminHandler, command string, conversationID string, userName string) (string, error) {
+	switch command {
+	case "reset":
+		err := handler.ResetConversation(conversationID, userName)
+		if err != nil {
+			return "", err
+		}
+		return resetMessage, nil
+	case "status":
+		return handler.ConversationStatus(conversationID)
+	case "model":
+		return handler.ModelInfo()
+	case "scratchpad show":
+		return handler.ScratchPad()
+	case "skills list":
+		return handler.SkillList()
+	case "mcp list":
+		return handler.MCPServerList()
+	default:
+		return "Unknown command", nil
+	}
+}
+
+// commandPath joins the names of the subcommand groups and subcommand that were used, such as "scratchpad show".
+func commandPath(options []*discordgo.ApplicationCommandInteractionDataOption) string {
+	names := make([]string, 0)
+	for len(options) > 0 {
+		option := options[0]
+		if option.Type != discordgo.ApplicationCommandOptionSubCommand && option.Type != discordgo.ApplicationCommandOptionSubCommandGroup {
+			break
+		}
+		names = append(names, option.Name)
+		options = option.Options
+	}
+	return strings.Join(names, " ")
+}
+
+func respondToCommand(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The number of replied-to messages that are remembered, so that edits and deletes of older messages are ignored.
+const maxDiscordLoggedReplies = 1000
+
+// discordLoggedReply is the agent's reply to a message.
+type discordLoggedReply struct {
+	conversationID string
+	// The content of the message that was replied to, when it was replied to.
+	content    string
+	channelID  string
+	messageIDs []string
+	// The ids of every message the reply answers, if it answered several messages together.
+	batch []string
+}
+
+func newDiscordReplyLog() *discordReplyLog {
+	return &discordReplyLog{replies: make(map[string]discordLoggedReply)}
+}
+
+// discordReplyLog remembers which messages the agent sent in reply to recent messages, so that the reply can be replaced if the message is edited, or removed if it is deleted.
+type discordReplyLog struct {
+	lock    sync.Mutex
+	replies map[string]discordLoggedReply
+	// The ids of the messages in replies, oldest first.
+	order []string
+}
+
+// record remembers the reply that a sink sent for a message, forgetting the message if nothing was sent.
+// If the reply answered other messages too, they are logged as sharing it when they are recorded, and any that already are are updated, as the reply may have been sent again.
+func (l *discordReplyLog) record(m *discordgo.Message, conversationID string, sink *discordReplySink) {
+	channelID, messageIDs := sink.replySink().sentMessages()
+	batch := sink.batchIDs()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	others := slices.DeleteFunc(slices.Clone(batch), func(id string) bool { return id == m.ID })
+	l.updateLocked(others, conversationID, channelID, messageIDs, batch)
+	if len(messageIDs) == 0 {
+		l.removeLocked(m.ID)
+		return
+	}
+	if _, ok := l.replies[m.ID]; !ok {
+		l.order = append(l.order, m.ID)
+	}
+	l.replies[m.ID] = discordLoggedReply{
+		conversationID: conversationID,
+		content:        m.Content,
+		channelID:      channelID,
+		messageIDs:     messageIDs,
+		batch:          batch,
+	}
+	for len(l.order) > maxDiscordLoggedReplies {
+		delete(l.replies, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// recordShared updates the messages whose reply a sink sent again, after another message the reply answered was deleted.
+func (l *discordReplyLog) recordShared(conversationID string, sink *discordReplySink) {
+	channelID, messageIDs := sink.sentMessages()
+	batch := sink.batchIDs()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.updateLocked(batch, conversationID, channelID, messageIDs, batch)
+}
+
+// updateLocked points the logged replies of messages at a reply that was sent again, forgetting the messages if nothing was sent.
+// Messages that are not logged are left alone, l.lock must already be held.
+func (l *discordReplyLog) updateLocked(ids []string, conversationID string, channelID string, messageIDs []string, batch []string) {
+	for _, id := range ids {
+		logged, ok := l.replies[id]
+		if !ok {
+			continue
+		}
+		if len(messageIDs) == 0 {
+			l.removeLocked(id)
+			continue
+		}
+		logged.conversationID, logged.channelID, logged.messageIDs, logged.batch = conversationID, channelID, messageIDs, batch
+		l.replies[id] = logged
+	}
+}
+
+// sharesReply checks whether a reply answers any message other than the given one that is still logged.
+func (l *discordReplyLog) sharesReply(reply discordLoggedReply, messageID string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return slices.ContainsFunc(reply.batch, func(id string) bool {
+		_, ok := l.replies[id]
+		return id != messageID && ok
+	})
+}
+
+func (l *discordReplyLog) get(messageID string) (discordLoggedReply, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reply, ok := l.replies[messageID]
+	return reply, ok
+}
+
+func (l *discordReplyLog) remove(messageID string) (discordLoggedReply, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reply, ok := l.replies[messageID]
+	l.removeLocked(messageID)
+	return reply, ok
+}
+
+func (l *discordReplyLog) removeLocked(messageID string) {
+	if _, ok := l.replies[messageID]; !ok {
+		return
+	}
+	delete(l.replies, messageID)
+	for i, id := range l.order {
+		if id == messageID {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// onMessageUpdate answers a message again if it is edited after the agent replied to it, editing the earlier reply.
+func (d *DiscordFrontend) onMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate, handler EditHandler) {
+	if m.Author == nil || m.Author.ID == s.State.User.ID {
+		return
+	}
+	logged, ok := d.replies.get(m.ID)
+	if !ok || logged.content == m.Content {
+		// Either the agent did not reply to the message, or the update did not change the content (for example, a link preview was added).
+		return
+	}
+	if m.Member == nil && m.GuildID != "" {
+		// Updates do not always include the author's member, which their roles (and so the tools they are permitted to use) come from.
+		member, err := s.GuildMember(m.GuildID, m.Author.ID)
+		if err != nil {
+			d.logger.Error("Failed to get member of edited message", "err", err.Error())
+			return
+		}
+		m.Member = member
+	}
+	msg, sink, ok := d.incomingMessage(s, m.Message)
+	if !ok {
+		return
+	}
+	// The reply already exists (in a thread, if one was started for it), so it is edited rather than sent again.
+	msg.Conversation.ID = logged.conversationID
+	sink.replace(logged)
+	handler.HandleEdit(msg, sink)
+	d.replies.record(m.Message, logged.conversationID, sink)
+}
+
+// onMessageDelete forgets a deleted message, deleting the agent's reply to it if it should.
+// If the reply also answered other messages, it is replaced with a reply to the rest of them instead.
+func (d *DiscordFrontend) onMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete, handler EditHandler) {
+	conversationID := m.ChannelID
+	logged, ok := d.replies.remove(m.ID)
+	if ok && d.replies.sharesReply(logged, m.ID) {
+		sink := &discordReplySink{session: s, showStatus: d.showToolStatus}
+		sink.replace(logged)
+		handler.HandleDelete(logged.conversationID, m.ID, sink)
+		d.replies.recordShared(logged.conversationID, sink)
+		return
+	}
+	if ok {
+		conversationID = logged.conversationID
+		if d.deleteReplies {
+			for _, messageID := range logged.messageIDs {
+				err := s.ChannelMessageDelete(logged.channelID, messageID)
+				if err != nil {
+					d.logger.Warn("Failed to delete reply", "channel", logged.channelID, "message", messageID, "err", err.Error())
+				}
+			}
+		}
+	}
+	handler.HandleDelete(conversationID, m.ID, nil)
+}
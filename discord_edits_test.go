@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestReplyLogSharesBatchReply(t *testing.T) {
+	log := newDiscordReplyLog()
+	first, second := &discordReplySink{}, &discordReplySink{channelID: "channel", sent: []string{"reply"}}
+	first.AnsweredWith(second, []string{"1", "2"})
+	second.AnsweredWith(second, []string{"1", "2"})
+	log.record(&discordgo.Message{ID: "1", Content: "how do I"}, "conversation", first)
+	log.record(&discordgo.Message{ID: "2", Content: "bake bread?"}, "conversation", second)
+
+	for _, id := range []string{"1", "2"} {
+		logged, ok := log.get(id)
+		if !ok || logged.channelID != "channel" || !slices.Equal(logged.messageIDs, []string{"reply"}) {
+			t.Errorf("message %s logged as %+v, %v, want the shared reply", id, logged, ok)
+		}
+	}
+	if logged, _ := log.get("1"); logged.content != "how do I" {
+		t.Errorf("message 1 logged with content %q", logged.content)
+	}
+
+	// Editing one message sends the reply again, which the other message now shares.
+	edited := &discordReplySink{channelID: "channel", sent: []string{"reply", "more"}}
+	edited.AnsweredWith(edited, []string{"1", "2"})
+	log.record(&discordgo.Message{ID: "1", Content: "how can I"}, "conversation", edited)
+	if logged, _ := log.get("2"); !slices.Equal(logged.messageIDs, []string{"reply", "more"}) || logged.content != "bake bread?" {
+		t.Errorf("message 2 logged as %+v after message 1 was edited", logged)
+	}
+
+	// Deleting one message replaces the reply with an answer to the other.
+	logged, _ := log.remove("1")
+	if !log.sharesReply(logged, "1") {
+		t.Fatal("the reply should still be shared with message 2")
+	}
+	replacement := &discordReplySink{channelID: "channel", sent: []string{"reply"}}
+	replacement.AnsweredWith(replacement, []string{"2"})
+	log.recordShared("conversation", replacement)
+	if logged, ok := log.get("2"); !ok || !slices.Equal(logged.messageIDs, []string{"reply"}) || !slices.Equal(logged.batch, []string{"2"}) {
+		t.Errorf("message 2 logged as %+v, %v after message 1 was deleted", logged, ok)
+	}
+	if logged, _ := log.remove("2"); log.sharesReply(logged, "2") {
+		t.Error("the reply should not be shared once every other message is deleted")
+	}
+}
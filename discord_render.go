@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The maximum number of characters in a single discord message.
+const discordMessageLimit = 2000
+
+// Replies that would take more than this many messages are uploaded as a file instead.
+const maxDiscordReplyMessages = 4
+
+const discordReplyAttachmentName = "response.md"
+
+const discordReplyAttachmentNote = "My response was too long to post as messages, so I have attached it as a file."
+
+// renderDiscordReply converts a reply into the messages that should be sent to discord.
+// Short replies are split into messages on paragraph and code block boundaries, long replies become a single file attachment.
+func renderDiscordReply(content string) []*discordgo.MessageSend {
+	chunks := splitDiscordMessage(content, discordMessageLimit)
+	if len(chunks) > maxDiscordReplyMessages {
+		return []*discordgo.MessageSend{{
+			Content: discordReplyAttachmentNote,
+			Files: []*discordgo.File{{
+				Name:        discordReplyAttachmentName,
+				ContentType: "text/markdown",
+				Reader:      strings.NewReader(content),
+			}},
+		}}
+	}
+	messages := make([]*discordgo.MessageSend, len(chunks))
+	for i, chunk := range chunks {
+		messages[i] = &discordgo.MessageSend{Content: chunk}
+	}
+	return messages
+}
+
+// Code blocks with more lines than this are sent as files, rather than in the message.
+const maxDiscordCodeBlockLines = 40
+
+// Discord allows at most this many files, and this many embeds, on a single message.
+const (
+	maxDiscordFilesPerMessage  = 10
+	maxDiscordEmbedsPerMessage = 10
+)
+
+// File extensions for the languages of code blocks that are sent as files. Other languages use their name as the extension.
+var codeBlockExtensions = map[string]string{
+	"":           "txt",
+	"text":       "txt",
+	"python":     "py",
+	"javascript": "js",
+	"typescript": "ts",
+	"golang":     "go",
+	"rust":       "rs",
+	"ruby":       "rb",
+	"bash":       "sh",
+	"shell":      "sh",
+	"markdown":   "md",
+	"csharp":     "cs",
+	"c++":        "cpp",
+	"kotlin":     "kt",
+	"yml":        "yaml",
+}
+
+// renderDiscordRichReply converts a reply with files and embeds into the messages that should be sent to discord.
+// Long code blocks are moved into files, and files and embeds are attached to the last message (with more messages added if they do not fit on one).
+func renderDiscordRichReply(content string, files []ReplyFile, embeds []ReplyEmbed) []*discordgo.MessageSend {
+	content, snippets := extractLongCodeBlocks(content)
+	messages := renderDiscordReply(content)
+
+	discordFiles := make([]*discordgo.File, 0)
+	for _, file := range append(snippets, files...) {
+		discordFiles = append(discordFiles, &discordgo.File{
+			Name:        file.Name,
+			ContentType: "text/plain",
+			Reader:      strings.NewReader(file.Content),
+		})
+	}
+	discordEmbeds := make([]*discordgo.MessageEmbed, 0)
+	for _, embed := range embeds {
+		discordEmbed := &discordgo.MessageEmbed{
+			Title:       embed.Title,
+			Description: embed.Description,
+			URL:         embed.URL,
+			Color:       embed.Color,
+		}
+		for _, field := range embed.Fields {
+			discordEmbed.Fields = append(discordEmbed.Fields, &discordgo.MessageEmbedField{Name: field.Name, Value: field.Value, Inline: field.Inline})
+		}
+		discordEmbeds = append(discordEmbeds, discordEmbed)
+	}
+
+	for len(discordFiles) > 0 || len(discordEmbeds) > 0 {
+		last := messages[len(messages)-1]
+		nFiles := min(len(discordFiles), maxDiscordFilesPerMessage-len(last.Files))
+		nEmbeds := min(len(discordEmbeds), maxDiscordEmbedsPerMessage-len(last.Embeds))
+		if nFiles == 0 && nEmbeds == 0 {
+			messages = append(messages, &discordgo.MessageSend{})
+			continue
+		}
+		last.Files = append(last.Files, discordFiles[:nFiles]...)
+		last.Embeds = append(last.Embeds, discordEmbeds[:nEmbeds]...)
+		discordFiles, discordEmbeds = discordFiles[nFiles:], discordEmbeds[nEmbeds:]
+	}
+	return messages
+}
+
+// extractLongCodeBlocks replaces code blocks that are too long to comfortably read in a message with a note, returning the code blocks as files.
+func extractLongCodeBlocks(content string) (string, []ReplyFile) {
+	lines := strings.Split(content, "\n")
+	kept := make([]string, 0, len(lines))
+	files := make([]ReplyFile, 0)
+	for i := 0; i < len(lines); i++ {
+		opener := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(opener, "```") {
+			kept = append(kept, lines[i])
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[end]), "```") {
+			end++
+		}
+		if end >= len(lines) || end-i-1 <= maxDiscordCodeBlockLines {
+			// Unclosed or short code blocks are left in the message.
+			kept = append(kept, lines[i:min(end+1, len(lines))]...)
+			i = end
+			continue
+		}
+		language := ""
+		if fields := strings.Fields(strings.TrimPrefix(opener, "```")); len(fields) > 0 {
+			language = strings.ToLower(fields[0])
+		}
+		ext, ok := codeBlockExtensions[language]
+		if !ok {
+			ext = language
+			if strings.ContainsFunc(ext, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+				ext = "txt"
+			}
+		}
+		name := fmt.Sprintf("snippet%d.%s", len(files)+1, ext)
+		files = append(files, ReplyFile{Name: name, Content: strings.Join(lines[i+1:end], "\n")})
+		kept = append(kept, fmt.Sprintf("*(code attached as `%s`)*", name))
+		i = end
+	}
+	return strings.Join(kept, "\n"), files
+}
+
+// markdownBlock is either a paragraph of text or a fenced code block.
+type markdownBlock struct {
+	lines  []string
+	isCode bool
+}
+
+// splitMarkdownBlocks splits markdown into paragraphs (separated by blank lines) and code blocks.
+// Blank lines inside code blocks are kept in the code block.
+func splitMarkdownBlocks(content string) []markdownBlock {
+	blocks := make([]markdownBlock, 0)
+	var current *markdownBlock
+	flush := func() {
+		if current != nil && len(current.lines) > 0 {
+			blocks = append(blocks, *current)
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(content, "\n") {
+		isFence := strings.HasPrefix(strings.TrimSpace(line), "```")
+		switch {
+		case current != nil && current.isCode:
+			current.lines = append(current.lines, line)
+			if isFence {
+				flush()
+			}
+		case isFence:
+			flush()
+			current = &markdownBlock{lines: []string{line}, isCode: true}
+		case strings.TrimSpace(line) == "":
+			flush()
+		default:
+			if current == nil {
+				current = &markdownBlock{}
+			}
+			current.lines = append(current.lines, line)
+		}
+	}
+	flush()
+	return blocks
+}
+
+// splitDiscordMessage splits content into chunks of at most limit characters.
+// It prefers to split between paragraphs and code blocks, and when a code block has to be split, each chunk of it is fenced so code blocks stay balanced.
+func splitDiscordMessage(content string, limit int) []string {
+	if utf8.RuneCountInString(content) <= limit {
+		return []string{content}
+	}
+	chunks := make([]string, 0)
+	current := ""
+	add := func(piece string) {
+		if current == "" {
+			current = piece
+		} else if utf8.RuneCountInString(current)+2+utf8.RuneCountInString(piece) <= limit {
+			current += "\n\n" + piece
+		} else {
+			chunks = append(chunks, current)
+			current = piece
+		}
+	}
+	for _, block := range splitMarkdownBlocks(content) {
+		text := strings.Join(block.lines, "\n")
+		if utf8.RuneCountInString(text) <= limit {
+			add(text)
+			continue
+		}
+		var pieces []string
+		if block.isCode {
+			pieces = splitCodeBlock(block.lines, limit)
+		} else {
+			pieces = packLines(block.lines, limit)
+		}
+		for _, piece := range pieces {
+			add(piece)
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	if len(chunks) == 0 {
+		// The content was only blank lines.
+		return []string{string([]rune(content)[:limit])}
+	}
+	return chunks
+}
+
+// The least room for code that each chunk of a split code block must have, otherwise the code block is split as plain text.
+const minCodeBlockBudget = 100
+
+// splitCodeBlock splits an oversized code block into several code blocks, each with the same opening fence.
+func splitCodeBlock(lines []string, limit int) []string {
+	opener := lines[0]
+	body := lines[1:]
+	if len(body) > 0 && strings.HasPrefix(strings.TrimSpace(body[len(body)-1]), "```") {
+		body = body[:len(body)-1]
+	}
+	const closer = "```"
+	budget := limit - utf8.RuneCountInString(opener) - len(closer) - 2
+	if len(body) == 0 || budget < minCodeBlockBudget {
+		// There is no code to fence, or the opening fence leaves too little room for any, so split it like any other text.
+		return packLines(lines, limit)
+	}
+	pieces := packLines(body, budget)
+	for i, piece := range pieces {
+		pieces[i] = opener + "\n" + piece + "\n" + closer
+	}
+	return pieces
+}
+
+// packLines joins lines into as few pieces of at most limit characters as possible, breaking up lines that are too long by themselves.
+func packLines(lines []string, limit int) []string {
+	pieces := make([]string, 0)
+	current := ""
+	hasCurrent := false
+	for _, line := range lines {
+		for _, part := range splitLongLine(line, limit) {
+			if !hasCurrent {
+				current, hasCurrent = part, true
+			} else if utf8.RuneCountInString(current)+1+utf8.RuneCountInString(part) <= limit {
+				current += "\n" + part
+			} else {
+				pieces = append(pieces, current)
+				current = part
+			}
+		}
+	}
+	if hasCurrent {
+		pieces = append(pieces, current)
+	}
+	return pieces
+}
+
+// splitLongLine breaks a line into parts of at most limit characters, preferring to break at spaces.
+func splitLongLine(line string, limit int) []string {
+	limit = max(limit, 1)
+	runes := []rune(line)
+	parts := make([]string, 0, 1)
+	for len(runes) > limit {
+		cut := limit
+		for i := limit; i > limit/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = runes[cut:]
+		if len(runes) > 0 && runes[0] == ' ' {
+			runes = runes[1:]
+		}
+	}
+	return append(parts, string(runes))
+}
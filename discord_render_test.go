@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitDiscordMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		limit   int
+		want    []string
+	}{
+		{
+			name:    "short message",
+			content: "hello",
+			limit:   10,
+			want:    []string{"hello"},
+		},
+		{
+			name:    "splits between paragraphs",
+			content: "first paragraph\n\nsecond paragraph",
+			limit:   20,
+			want:    []string{"first paragraph", "second paragraph"},
+		},
+		{
+			name:    "packs paragraphs together",
+			content: "one\n\ntwo\n\nthree four five six",
+			limit:   20,
+			want:    []string{"one\n\ntwo", "three four five six"},
+		},
+		{
+			name:    "breaks long lines at spaces",
+			content: "aaaa bbbb cccc dddd",
+			limit:   10,
+			want:    []string{"aaaa bbbb", "cccc dddd"},
+		},
+		{
+			name:    "fences each chunk of a code block",
+			content: "```go\n" + strings.Repeat("x := 1\n", 30) + "```",
+			limit:   120,
+			want: []string{
+				"```go\n" + strings.TrimSuffix(strings.Repeat("x := 1\n", 15), "\n") + "\n```",
+				"```go\n" + strings.TrimSuffix(strings.Repeat("x := 1\n", 15), "\n") + "\n```",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitDiscordMessage(test.content, test.limit)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("splitDiscordMessage() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// Content that cannot be split neatly must still be split into chunks that fit, without losing any of it.
+func TestSplitDiscordMessageAwkwardContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"long code fence opener", "```" + strings.Repeat("x", 2100) + "\nline\n```"},
+		{"unclosed fence with no body", "hello\n```" + strings.Repeat("x", 2100)},
+		{"long line in code block", "```\n" + strings.Repeat("y", 5000) + "\n```"},
+		{"long word", strings.Repeat("z", 4500)},
+		{"multibyte characters", strings.Repeat("é", 2500)},
+		{"only blank lines", strings.Repeat("\n", 2500)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitDiscordMessage(test.content, discordMessageLimit)
+			if len(got) == 0 {
+				t.Fatal("splitDiscordMessage() returned no chunks")
+			}
+			for i, chunk := range got {
+				if n := utf8.RuneCountInString(chunk); n > discordMessageLimit {
+					t.Errorf("chunk %d has %d characters, more than the limit of %d", i, n, discordMessageLimit)
+				}
+			}
+			if want, have := visibleText(test.content), visibleText(strings.Join(got, "")); want != have {
+				t.Errorf("chunks contain %d visible characters, want %d", len(have), len(want))
+			}
+		})
+	}
+}
+
+// visibleText removes whitespace and fences, which splitting may add or remove, from content.
+func visibleText(content string) string {
+	content = strings.ReplaceAll(content, "```", "")
+	return strings.Join(strings.Fields(content), "")
+}
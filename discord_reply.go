@@ -0,0 +1,331 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// How often a streaming reply is edited to show new text, this is limited to stay clear of discord's rate limits.
+const discordStreamEditInterval = 1500 * time.Millisecond
+
+// Discord shows a typing indicator for about 10 seconds, so it must be refreshed more often than that.
+const discordTypingInterval = 8 * time.Second
+
+// Shown in the reply message before any text has been streamed.
+const discordStreamPlaceholder = "…"
+
+// discordReplySink sends replies to a discord channel.
+// While a reply is being worked on, a status line or the streamed reply is shown in a placeholder message which is periodically edited, and then replaced with the final reply.
+type discordReplySink struct {
+	session    *discordgo.Session
+	channelID  string
+	showStatus bool
+	// If set, a thread is started for the reply just before anything is first sent, and the reply is sent there instead.
+	thread *discordThreadStart
+	// The id of the thread that was started for the reply, once it has been started.
+	threadID string
+	// If set, the first message that is sent is a discord reply to this message.
+	replyTo *discordgo.MessageReference
+	// Any messages after the first of an earlier reply that this reply replaces (the first is reused as the reply message), which are deleted once the reply is sent.
+	replaced []string
+
+	lock sync.Mutex
+	// If the message was answered along with other messages, the sink the reply was sent to (unless it is this one), and the ids of every message the reply answers.
+	answeredBy *discordReplySink
+	batch      []string
+	messageID  string
+	// The ids of the messages of the reply that have been sent.
+	sent    []string
+	text    string
+	dirty   bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func (r *discordReplySink) BeginStream() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// If generation is retried, start the text again but keep the same message.
+	r.text = ""
+	r.dirty = true
+	if r.messageID == "" {
+		msg, err := r.sendLocked(discordStreamPlaceholder)
+		if err != nil {
+			// The final reply will still be sent as normal.
+			return
+		}
+		r.messageID = msg.ID
+	} else if r.stop == nil {
+		// The message is showing a status, which is no longer relevant.
+		r.session.ChannelMessageEdit(r.channelID, r.messageID, discordStreamPlaceholder)
+	}
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+		r.stopped = make(chan struct{})
+		go r.editPeriodically(r.stop, r.stopped)
+	}
+}
+
+func (r *discordReplySink) StartTyping() func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(discordTypingInterval)
+		defer ticker.Stop()
+		for {
+			r.session.ChannelTyping(r.currentChannel())
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// ShowStatus shows a status line in the reply message, which will later be replaced by the reply itself.
+func (r *discordReplySink) ShowStatus(status string) {
+	if !r.showStatus {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop != nil {
+		// The reply has started streaming, which is more interesting than the status.
+		return
+	}
+	content := "-# " + status + "…"
+	if r.messageID == "" {
+		msg, err := r.sendLocked(content)
+		if err == nil {
+			r.messageID = msg.ID
+		}
+	} else {
+		r.session.ChannelMessageEdit(r.channelID, r.messageID, content)
+	}
+}
+
+func (r *discordReplySink) StreamText(text string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.text += text
+	r.dirty = true
+}
+
+func (r *discordReplySink) CancelStream() {
+	messageID := r.stopStreaming()
+	if messageID != "" {
+		r.session.ChannelMessageDelete(r.currentChannel(), messageID)
+	}
+	r.deleteReplaced()
+}
+
+func (r *discordReplySink) Reply(content string) error {
+	return r.RichReply(content, nil, nil)
+}
+
+func (r *discordReplySink) RichReply(content string, files []ReplyFile, embeds []ReplyEmbed) error {
+	messageID := r.stopStreaming()
+	channelID := r.channel()
+	messages := renderDiscordRichReply(content, files, embeds)
+	if messageID != "" {
+		// Replace the streamed message with the first part of the final reply.
+		first := messages[0]
+		edit := discordgo.NewMessageEdit(channelID, messageID).SetContent(first.Content)
+		edit.Files = first.Files
+		// The message may be an earlier reply, so its embeds and attachments are replaced rather than added to.
+		edit.Embeds = &[]*discordgo.MessageEmbed{}
+		if len(first.Embeds) > 0 {
+			edit.Embeds = &first.Embeds
+		}
+		edit.Attachments = &[]*discordgo.MessageAttachment{}
+		_, err := r.session.ChannelMessageEditComplex(edit)
+		if err != nil {
+			return err
+		}
+		r.recordSent(messageID)
+		messages = messages[1:]
+	}
+	if len(messages) > 0 {
+		messages[0].Reference = r.takeReplyTo()
+	}
+	for _, msg := range messages {
+		sent, err := r.session.ChannelMessageSendComplex(channelID, msg)
+		if err != nil {
+			return err
+		}
+		r.recordSent(sent.ID)
+	}
+	r.deleteReplaced()
+	return nil
+}
+
+func (r *discordReplySink) recordSent(messageID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sent = append(r.sent, messageID)
+}
+
+// sentMessages returns the channel the reply was sent to, and the ids of the messages it was sent as.
+func (r *discordReplySink) sentMessages() (string, []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.channelID, slices.Clone(r.sent)
+}
+
+func (r *discordReplySink) AnsweredWith(replySink ReplySink, messageIDs []string) {
+	reply, _ := replySink.(*discordReplySink)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reply != r {
+		r.answeredBy = reply
+	}
+	r.batch = slices.Clone(messageIDs)
+}
+
+// replySink returns the sink the reply to the message was sent to, which is another message's sink if the message was answered along with it.
+func (r *discordReplySink) replySink() *discordReplySink {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.answeredBy != nil {
+		return r.answeredBy
+	}
+	return r
+}
+
+// batchIDs returns the ids of every message the reply answers, if the message was answered along with others.
+func (r *discordReplySink) batchIDs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.batch)
+}
+
+// replace makes the sink replace an earlier reply, by editing its first message and deleting the rest, rather than sending a new one.
+func (r *discordReplySink) replace(logged discordLoggedReply) {
+	r.thread, r.replyTo = nil, nil
+	r.channelID, r.messageID, r.replaced = logged.channelID, logged.messageIDs[0], logged.messageIDs[1:]
+}
+
+// deleteReplaced deletes the remaining messages of the earlier reply that this reply replaces.
+func (r *discordReplySink) deleteReplaced() {
+	r.lock.Lock()
+	channelID, replaced := r.channelID, r.replaced
+	r.replaced = nil
+	r.lock.Unlock()
+	for _, messageID := range replaced {
+		r.session.ChannelMessageDelete(channelID, messageID)
+	}
+}
+
+// stopStreaming stops editing the placeholder message, returning its id (or an empty string if there is no placeholder message).
+// After stopping, the sink can be used to send a new reply.
+func (r *discordReplySink) stopStreaming() string {
+	r.lock.Lock()
+	messageID, stop, stopped := r.messageID, r.stop, r.stopped
+	r.messageID, r.text, r.dirty, r.stop, r.stopped = "", "", false, nil, nil
+	r.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+	return messageID
+}
+
+func (r *discordReplySink) editPeriodically(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(discordStreamEditInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.lock.Lock()
+			channelID, messageID, text, dirty := r.channelID, r.messageID, r.text, r.dirty
+			r.dirty = false
+			r.lock.Unlock()
+			if !dirty || text == "" {
+				continue
+			}
+			r.session.ChannelMessageEdit(channelID, messageID, previewDiscordReply(text))
+		}
+	}
+}
+
+// sendLocked sends a message to the reply's channel, as a reply to replyTo if nothing has been sent yet. r.lock must already be held.
+func (r *discordReplySink) sendLocked(content string) (*discordgo.Message, error) {
+	channelID := r.channelLocked()
+	msg, err := r.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content, Reference: r.replyTo})
+	if err == nil {
+		r.replyTo = nil
+	}
+	return msg, err
+}
+
+// takeReplyTo returns the message the next message should reply to, if any, so that only the first message is a reply.
+func (r *discordReplySink) takeReplyTo() *discordgo.MessageReference {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	replyTo := r.replyTo
+	r.replyTo = nil
+	return replyTo
+}
+
+// channel returns the channel the reply is sent to, starting the reply's thread if it has not been started yet.
+func (r *discordReplySink) channel() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.channelLocked()
+}
+
+// channelLocked is the same as channel, but r.lock must already be held.
+func (r *discordReplySink) channelLocked() string {
+	if r.thread != nil {
+		thread, err := r.session.MessageThreadStartComplex(r.channelID, r.thread.messageID, &discordgo.ThreadStart{
+			Name:                r.thread.name,
+			AutoArchiveDuration: r.thread.autoArchiveMinutes,
+		})
+		r.thread = nil
+		// If the thread could not be started, reply in the channel instead.
+		if err == nil {
+			r.channelID = thread.ID
+			r.threadID = thread.ID
+			// The thread is started from the message, so there is no need to reply to it as well (and it cannot be replied to from the thread).
+			r.replyTo = nil
+		}
+	}
+	return r.channelID
+}
+
+// startsThread checks whether the reply has started, or will start, a thread.
+func (r *discordReplySink) startsThread() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.thread != nil || r.threadID != ""
+}
+
+// startedThread returns the id of the thread that was started for the reply, or an empty string if none was started.
+func (r *discordReplySink) startedThread() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.threadID
+}
+
+// currentChannel returns the channel the reply is currently being sent to, without starting the reply's thread.
+func (r *discordReplySink) currentChannel() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.channelID
+}
+
+// previewDiscordReply shortens a partial reply so that it fits in a single message.
+func previewDiscordReply(text string) string {
+	runes := []rune(text)
+	if len(runes) <= discordMessageLimit {
+		return text
+	}
+	return string(runes[:discordMessageLimit-1]) + "…"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"craig/data"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord only allows threads to be archived after one of these durations (in minutes).
+var discordArchiveDurations = []int{60, 1440, 4320, 10080}
+
+// Names of threads that Craig starts are cut down to this many characters.
+const discordThreadNameLength = 80
+
+// discordThreadStart describes a thread to start from a message.
+type discordThreadStart struct {
+	messageID          string
+	name               string
+	autoArchiveMinutes int
+}
+
+// threadRule finds the thread rule for a channel.
+func (d *DiscordFrontend) threadRule(channelID string) data.ThreadRule {
+	if rule, ok := d.threads.Channels[channelID]; ok {
+		return rule
+	}
+	return d.threads.Default
+}
+
+// newThreadStart decides how to start a thread from a message.
+func newThreadStart(m *discordgo.Message, authorName string, rule data.ThreadRule) *discordThreadStart {
+	return &discordThreadStart{
+		messageID:          m.ID,
+		name:               threadName(m.Content, authorName),
+		autoArchiveMinutes: archiveDuration(rule.AutoArchiveMinutes),
+	}
+}
+
+// threadName names a thread after the message that started it.
+func threadName(content string, authorName string) string {
+	name := strings.Join(strings.Fields(content), " ")
+	if name == "" {
+		return "Chat with " + authorName
+	}
+	runes := []rune(name)
+	if len(runes) > discordThreadNameLength {
+		name = string(runes[:discordThreadNameLength-1]) + "…"
+	}
+	return name
+}
+
+// archiveDuration rounds up to the nearest archive duration that discord allows.
+func archiveDuration(minutes int) int {
+	for _, duration := range discordArchiveDurations {
+		if minutes <= duration {
+			return duration
+		}
+	}
+	return discordArchiveDurations[len(discordArchiveDurations)-1]
+}
@@ -0,0 +1,198 @@
+package main
+
+import "craig/ai/tools"
+
+// Author identifies the person who sent a message on a chat surface.
+type Author struct {
+	ID   string
+	Name string
+	// The ids of the roles the author has, if the frontend has roles.
+	Roles []string
+}
+
+// Conversation identifies where a message was sent, and how that place should be described to the agent.
+type Conversation struct {
+	ID string
+	// The id of the place the conversation is part of, such as the channel of a thread, or empty if there is none.
+	ParentID string
+	Location string
+	Audience Audience
+	// Whether the agent started the conversation (such as a thread it created for a reply), so it is talking with the agent.
+	StartedByAgent bool
+	// Whether the conversation is only between the agent and the author (such as a dm), so every message is meant for the agent.
+	Private bool
+	// Whether messages sent in quick succession can be answered with a single reply, as people may send several messages without waiting for a reply to each.
+	BatchReplies bool
+}
+
+// Audience describes who can see a conversation and who is taking part in it.
+// Zero values mean that the information is not known.
+type Audience struct {
+	// The number of people who can see the conversation, including the agent.
+	Members int
+	// The names of the people who have sent a message in the conversation recently.
+	ActiveParticipants []string
+	// The names of the people who have joined the thread, if the conversation is a thread.
+	ThreadMembers []string
+}
+
+// IncomingMessage is a platform-agnostic message that has been received by a frontend.
+type IncomingMessage struct {
+	// The id of the message, which is used to match it up with later edits and deletes. May be empty if the frontend does not support them.
+	ID string
+	// The ids of every message that this message combines, if it is several messages that are answered together.
+	CombinedIDs  []string
+	Author       Author
+	Conversation Conversation
+	Content      string
+	// Whether the message explicitly mentions the agent.
+	MentionsAgent bool
+	// Whether the message is a reply to one of the agent's messages.
+	RepliesToAgent bool
+	Attachments    []Attachment
+	// The messages this message is a reply to, the message it directly replies to first.
+	ReplyChain []QuotedMessage
+	// Actions that the agent can perform in the conversation, or nil if the frontend does not support any.
+	Actions ChannelActions
+	// LoadDetails fills in details of the message that are expensive to look up (the conversation's audience and the reply chain).
+	// It is only called once the agent may be run, and may be nil if the frontend fills them in straight away.
+	LoadDetails func(msg *IncomingMessage)
+}
+
+// QuotedMessage is another message that is relevant to a message, such as the message it replies to.
+type QuotedMessage struct {
+	AuthorName string
+	Content    string
+	// Whether the agent sent the message.
+	FromAgent bool
+}
+
+// ChannelActions performs actions in the conversation a message was sent in.
+// Message ids may be empty, in which case the message being replied to (for React and Pin) or the agent's most recent message (for EditOwnMessage and DeleteOwnMessage) is used.
+type ChannelActions interface {
+	React(messageID string, emoji string) error
+	Pin(messageID string) error
+	EditOwnMessage(messageID string, content string) error
+	DeleteOwnMessage(messageID string) error
+	// CreateThread starts a thread (from a message, if one is given), returning a description of the new thread.
+	CreateThread(name string, messageID string) (string, error)
+	// ReadHistory reads messages from the conversation, oldest first.
+	ReadHistory(query tools.HistoryQuery) ([]tools.HistoryMessage, error)
+}
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	Name        string
+	ContentType string
+	// The size of the file in bytes.
+	Size int
+	// Download fetches the content of the file.
+	Download func() ([]byte, error)
+}
+
+// ReplySink sends replies back to the conversation that a message came from.
+type ReplySink interface {
+	Reply(content string) error
+}
+
+// RichReplySink is a ReplySink that can also send files and embeds with a reply.
+type RichReplySink interface {
+	ReplySink
+	// RichReply is called instead of Reply when the reply has files or embeds. The content may be empty.
+	RichReply(content string, files []ReplyFile, embeds []ReplyEmbed) error
+}
+
+// ReplyFile is a file sent with a reply.
+type ReplyFile struct {
+	Name    string
+	Content string
+}
+
+// ReplyEmbed is a rich card sent with a reply.
+type ReplyEmbed struct {
+	Title       string
+	Description string
+	URL         string
+	Color       int
+	Fields      []ReplyEmbedField
+}
+
+type ReplyEmbedField struct {
+	Name   string
+	Value  string
+	Inline bool
+}
+
+// ErrorReplySink is a ReplySink that can tell a failure to answer apart from a reply.
+type ErrorReplySink interface {
+	ReplySink
+	// ReplyError is called instead of Reply when the message could not be answered because of an error.
+	ReplyError(content string) error
+}
+
+// StreamingReplySink is a ReplySink that can also show a reply while it is being generated.
+// Reply is still called with the full content once generation has finished.
+type StreamingReplySink interface {
+	ReplySink
+	// BeginStream is called when the reply starts generating, and may be called again if generation is retried.
+	BeginStream()
+	// StreamText is called with each new chunk of the reply.
+	StreamText(text string)
+	// CancelStream is called instead of Reply if there is nothing to reply with (for example, the agent chose not to reply).
+	CancelStream()
+}
+
+// BatchReplySink is a ReplySink that can be told that its message was answered along with other messages, by a single reply.
+type BatchReplySink interface {
+	ReplySink
+	// AnsweredWith is called once a message has been answered, with the sink the reply was sent to (which may be this sink) and the ids of every message the reply answers.
+	AnsweredWith(replySink ReplySink, messageIDs []string)
+}
+
+// StatusReplySink is a ReplySink that can show what is happening while a reply is being worked on.
+type StatusReplySink interface {
+	ReplySink
+	// ShowStatus is called with a short description of what is currently happening, such as "updating scratchpad".
+	ShowStatus(status string)
+}
+
+// TypingReplySink is a ReplySink that can show that a reply is being worked on.
+type TypingReplySink interface {
+	ReplySink
+	// StartTyping shows that a reply is being worked on until the returned function is called.
+	StartTyping() (stop func())
+}
+
+// MessageHandler processes messages received by a frontend.
+type MessageHandler interface {
+	HandleMessage(msg IncomingMessage, sink ReplySink)
+}
+
+// EditHandler is a MessageHandler that can also handle messages being edited or deleted.
+// Frontends that can tell when messages are edited or deleted pass them on if their handler implements this.
+type EditHandler interface {
+	MessageHandler
+	// HandleEdit is called when a message that the agent replied to is edited, with a sink that replaces the agent's earlier reply.
+	HandleEdit(msg IncomingMessage, sink ReplySink)
+	// HandleDelete is called when a message in a conversation is deleted.
+	// If the agent's reply to the message also answered other messages, sink replaces that reply, otherwise it is nil.
+	HandleDelete(conversationID string, messageID string, sink ReplySink)
+}
+
+// AdminHandler answers administrative commands, such as resetting a conversation or showing the scratchpad.
+// Frontends that support commands offer them if their handler implements this.
+// Responses are markdown intended for the person who ran the command.
+type AdminHandler interface {
+	ResetConversation(conversationID string, requestedBy string) error
+	ConversationStatus(conversationID string) (string, error)
+	ScratchPad() (string, error)
+	SkillList() (string, error)
+	ModelInfo() (string, error)
+	MCPServerList() (string, error)
+}
+
+// Frontend is a chat surface that receives messages and forwards them to a handler.
+type Frontend interface {
+	// Run blocks, forwarding messages to the handler, until the frontend is stopped.
+	Run(handler MessageHandler) error
+}
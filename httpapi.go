@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func NewHTTPFrontend(addr string, token string, logger *slog.Logger) *HTTPFrontend {
+	return &HTTPFrontend{
+		addr:   addr,
+		token:  token,
+		logger: logger,
+	}
+}
+
+// HTTPFrontend exposes the agent over a JSON API, with an OpenAI-compatible chat completions endpoint.
+// If token is not empty, requests must provide it as a bearer token. Without a token, it only listens on loopback addresses.
+type HTTPFrontend struct {
+	addr   string
+	token  string
+	logger *slog.Logger
+}
+
+const httpDefaultUserName = "API User"
+
+// Request bodies larger than this are rejected. This leaves room for a few images given as data URLs.
+const maxHTTPRequestBytes = 32 << 20
+
+func (h *HTTPFrontend) Run(handler MessageHandler) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", h.authorised(func(w http.ResponseWriter, r *http.Request) {
+		h.handleChatCompletions(w, r, handler)
+	}))
+	mux.HandleFunc("POST /api/message", h.authorised(func(w http.ResponseWriter, r *http.Request) {
+		h.handleMessage(w, r, handler)
+	}))
+	if h.token == "" && !isLoopbackAddr(h.addr) {
+		return fmt.Errorf("refusing to serve on %s without a token, set CRAIG_HTTP_TOKEN or listen on a loopback address", h.addr)
+	}
+	h.logger.Info("HTTP server is running", "addr", h.addr)
+	return http.ListenAndServe(h.addr, mux)
+}
+
+// isLoopbackAddr reports whether a listen address only accepts connections from the same machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (h *HTTPFrontend) authorised(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.token != "" && r.Header.Get("Authorization") != "Bearer "+h.token {
+			writeHTTPError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxHTTPRequestBytes)
+		next(w, r)
+	}
+}
+
+type apiMessageRequest struct {
+	Message        string `json:"message"`
+	UserName       string `json:"user_name"`
+	Location       string `json:"location"`
+	ConversationID string `json:"conversation_id"`
+	Stream         bool   `json:"stream"`
+}
+
+type apiMessageResponse struct {
+	Response string `json:"response"`
+}
+
+func (h *HTTPFrontend) handleMessage(w http.ResponseWriter, r *http.Request, handler MessageHandler) {
+	var req apiMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Message == "" {
+		writeHTTPError(w, http.StatusBadRequest, errors.New("missing 'message'"))
+		return
+	}
+	msg := newHTTPIncomingMessage(r, req.Message, req.UserName, req.Location, req.ConversationID)
+
+	if !req.Stream {
+		sink := &httpReplySink{}
+		handler.HandleMessage(msg, sink)
+		if sink.failed {
+			writeHTTPError(w, http.StatusInternalServerError, errors.New(sink.content))
+			return
+		}
+		writeJSON(w, http.StatusOK, apiMessageResponse{Response: sink.content})
+		return
+	}
+
+	sse, err := newSSEWriter(w)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sink := &httpStreamingReplySink{onText: func(text string) {
+		sse.send("text", map[string]string{"text": text})
+	}}
+	handler.HandleMessage(msg, sink)
+	if sink.failed {
+		sse.fail(errors.New(sink.content))
+		return
+	}
+	sse.send("done", apiMessageResponse{Response: sink.content})
+}
+
+type chatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+	Name    string `json:"name,omitempty"`
+}
+
+type chatCompletionRequest struct {
+	Model    string                  `json:"model"`
+	Messages []chatCompletionMessage `json:"messages"`
+	Stream   bool                    `json:"stream"`
+	User     string                  `json:"user"`
+}
+
+// handleChatCompletions implements the OpenAI chat completions API.
+// The agent keeps its own history, so only the last user message is sent to it.
+func (h *HTTPFrontend) handleChatCompletions(w http.ResponseWriter, r *http.Request, handler MessageHandler) {
+	var req chatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	var last *chatCompletionMessage
+	for i := range req.Messages {
+		if req.Messages[i].Role == "user" {
+			last = &req.Messages[i]
+		}
+	}
+	if last == nil {
+		writeHTTPError(w, http.StatusBadRequest, errors.New("no user message provided"))
+		return
+	}
+	content, err := chatCompletionContentText(last.Content)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	userName := last.Name
+	if userName == "" {
+		userName = req.User
+	}
+	msg := newHTTPIncomingMessage(r, content, userName, "", r.Header.Get("X-Craig-Conversation"))
+	msg.Attachments = chatCompletionImages(last.Content)
+
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	model := req.Model
+	if model == "" {
+		model = "craig"
+	}
+
+	if !req.Stream {
+		sink := &httpReplySink{}
+		handler.HandleMessage(msg, sink)
+		if sink.failed {
+			writeHTTPError(w, http.StatusInternalServerError, errors.New(sink.content))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   model,
+			"choices": []map[string]any{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": sink.content},
+				"finish_reason": "stop",
+			}},
+		})
+		return
+	}
+
+	sse, err := newSSEWriter(w)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chunk := func(delta map[string]string, finishReason any) map[string]any {
+		return map[string]any{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []map[string]any{{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			}},
+		}
+	}
+	// The first chunk is only sent with the first text, so that a failure before then can still be reported with an error status.
+	sentRole := false
+	sendRole := func() {
+		if !sentRole {
+			sentRole = true
+			sse.send("", chunk(map[string]string{"role": "assistant"}, nil))
+		}
+	}
+	sink := &httpStreamingReplySink{onText: func(text string) {
+		sendRole()
+		sse.send("", chunk(map[string]string{"content": text}, nil))
+	}}
+	handler.HandleMessage(msg, sink)
+	if sink.failed {
+		sse.fail(errors.New(sink.content))
+		return
+	}
+	sendRole()
+	sse.send("", chunk(map[string]string{}, "stop"))
+	sse.sendRaw("", "[DONE]")
+}
+
+// chatCompletionContentText extracts the text from message content, which may either be a string or a list of content parts.
+func chatCompletionContentText(content any) (string, error) {
+	switch content := content.(type) {
+	case string:
+		return content, nil
+	case []any:
+		texts := make([]string, 0)
+		for _, part := range content {
+			part, ok := part.(map[string]any)
+			if !ok || part["type"] != "text" {
+				continue
+			}
+			if text, ok := part["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n"), nil
+	default:
+		return "", errors.New("unsupported message content")
+	}
+}
+
+// chatCompletionImages extracts the images from message content that is a list of content parts.
+// Only images given as data URLs are supported, as fetching arbitrary URLs from the server is not safe.
+func chatCompletionImages(content any) []Attachment {
+	parts, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	images := make([]Attachment, 0)
+	for _, part := range parts {
+		part, ok := part.(map[string]any)
+		if !ok || part["type"] != "image_url" {
+			continue
+		}
+		imageURL, _ := part["image_url"].(map[string]any)
+		url, _ := imageURL["url"].(string)
+		mediaType, encoded, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ";base64,")
+		if !ok || !strings.HasPrefix(url, "data:") {
+			continue
+		}
+		images = append(images, Attachment{
+			Name:        fmt.Sprintf("image%d", len(images)+1),
+			ContentType: mediaType,
+			Size:        base64.StdEncoding.DecodedLen(len(encoded)),
+			Download: func() ([]byte, error) {
+				return base64.StdEncoding.DecodeString(encoded)
+			},
+		})
+	}
+	return images
+}
+
+// newHTTPIncomingMessage creates a message from a request.
+// Requests without a conversation id continue a conversation of their own: the user's, if they give a name, otherwise the client's.
+func newHTTPIncomingMessage(r *http.Request, content, userName, location, conversationID string) IncomingMessage {
+	if conversationID == "" {
+		if userName != "" {
+			conversationID = "user:" + userName
+		} else {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			conversationID = "client:" + host
+		}
+	}
+	if userName == "" {
+		userName = httpDefaultUserName
+	}
+	if location == "" {
+		location = "HTTP API(direct chat with a single user)"
+	}
+	return IncomingMessage{
+		Author: Author{
+			ID:   "http:" + userName,
+			Name: userName,
+		},
+		Conversation: Conversation{
+			ID:       "http:" + conversationID,
+			Location: location,
+			Private:  true,
+		},
+		Content: content,
+	}
+}
+
+type httpReplySink struct {
+	content string
+	// Whether the message could not be answered, in which case content is the error message.
+	failed bool
+}
+
+func (r *httpReplySink) Reply(content string) error {
+	r.content = content
+	return nil
+}
+
+func (r *httpReplySink) ReplyError(content string) error {
+	r.content, r.failed = content, true
+	return nil
+}
+
+// httpStreamingReplySink forwards streamed text as it arrives.
+// Text that has already been sent cannot be retracted, so if the response was not (fully) streamed, the remainder is sent when the reply completes.
+type httpStreamingReplySink struct {
+	httpReplySink
+	streamed string
+	onText   func(string)
+}
+
+func (r *httpStreamingReplySink) BeginStream() {}
+
+func (r *httpStreamingReplySink) CancelStream() {}
+
+func (r *httpStreamingReplySink) StreamText(text string) {
+	r.streamed += text
+	r.onText(text)
+}
+
+func (r *httpStreamingReplySink) Reply(content string) error {
+	r.content = content
+	if rest, ok := strings.CutPrefix(content, r.streamed); ok && rest != "" {
+		r.StreamText(rest)
+	}
+	return nil
+}
+
+// sseWriter sends server-sent events. The response status is only written with the first event, so until then an error can still be sent instead.
+type sseWriter struct {
+	lock    sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming is not supported")
+	}
+	return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+// fail reports an error, with an error status if no events have been sent yet, or otherwise as an error event.
+func (s *sseWriter) fail(err error) {
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+	if !started {
+		writeHTTPError(s.w, http.StatusInternalServerError, err)
+		return
+	}
+	s.send("error", map[string]any{"error": map[string]string{"message": err.Error()}})
+}
+
+func (s *sseWriter) send(event string, data any) {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	s.sendRaw(event, string(bs))
+}
+
+func (s *sseWriter) sendRaw(event string, data string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.Header().Set("Connection", "keep-alive")
+		s.w.WriteHeader(http.StatusOK)
+	}
+	if event != "" {
+		fmt.Fprintf(s.w, "event: %s\n", event)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	s.flusher.Flush()
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]string{"message": err.Error()},
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log/slog"
 	"os"
 	"strings"
@@ -8,20 +9,55 @@ import (
 
 func main() {
 	logger := slog.Default()
+	mode := "discord"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		mode, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(mode, flag.ExitOnError)
+	dataLocation := flags.String("data", "/craig-data/agent", "directory containing the agent data")
+	authorName := flags.String("name", "User", "author name to chat as (chat mode only)")
+	location := flags.String("location", "Terminal(direct chat with a single user)", "location to report to the agent (chat mode only)")
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on, which must be a loopback address unless CRAIG_HTTP_TOKEN is set (http mode only)")
+	toolStatus := flags.Bool("tool-status", true, "show which tools the agent is using while it works (discord mode only)")
+	deleteReplies := flags.Bool("delete-replies", true, "delete the agent's reply when the message it replied to is deleted (discord mode only)")
+	flags.Parse(args)
+
 	app, err := NewApp(
 		os.Getenv("OPENAI_KEY"),
 		os.Getenv("GEMINI_KEY"),
-		logger, "/craig-data/agent",
+		logger, *dataLocation,
 		strings.TrimSpace(strings.ToLower(os.Getenv("CRAIG_INIT"))) == "yes",
 	)
 	if err != nil {
 		panic(err)
 	}
-	session, err := NewSession(app, os.Getenv("CRAIG_DISCORD_TOKEN"))
-	if err != nil {
-		panic(err)
+
+	var frontend Frontend
+	switch mode {
+	case "discord":
+		access, err := app.data.AccessPolicy()
+		if err != nil {
+			panic(err)
+		}
+		threads, err := app.data.ThreadPolicy()
+		if err != nil {
+			panic(err)
+		}
+		frontend, err = NewDiscordFrontend(os.Getenv("CRAIG_DISCORD_TOKEN"), *toolStatus, *deleteReplies, access, threads, logger)
+		if err != nil {
+			panic(err)
+		}
+	case "chat":
+		frontend = NewTerminalFrontend(os.Stdin, os.Stdout, *authorName, *location)
+	case "http":
+		frontend = NewHTTPFrontend(*addr, os.Getenv("CRAIG_HTTP_TOKEN"), logger)
+	default:
+		logger.Error("Unrecognised mode", "mode", mode)
+		os.Exit(2)
 	}
-	err = RunSession(session, logger)
+	err = frontend.Run(app)
 	if err != nil {
 		panic(err)
 	}
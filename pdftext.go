@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Compressed streams are only decoded up to this many bytes, so that a small pdf cannot expand to fill memory.
+// Content streams are mostly drawing operators, so this leaves plenty of room for the text they contain.
+const maxPDFStreamBytes = 16 * maxFileChars
+
+// In a TJ array, a gap between strings at least this large (in thousandths of a unit of text space) is taken to be a space.
+const pdfWordGap = 200
+
+// extractPDFText makes a best effort at extracting the text from a pdf.
+// It only understands text drawn with the standard text operators in uncompressed or flate compressed content streams.
+// This covers most pdfs that were exported from documents, but not scanned pdfs or pdfs with unusual font encodings.
+func extractPDFText(content []byte) (string, error) {
+	if !bytes.HasPrefix(content, []byte("%PDF")) {
+		return "", errors.New("not a pdf")
+	}
+	var text strings.Builder
+	rest := content
+	for {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		dict := rest[:start]
+		if dictStart := bytes.LastIndex(dict, []byte("<<")); dictStart >= 0 {
+			dict = dict[dictStart:]
+		}
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		rest = body[end+len("endstream"):]
+		if bytes.HasSuffix(dict, []byte("end")) {
+			// This was the end of the previous stream's "endstream", not the start of a new one.
+			continue
+		}
+		data := body[:end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			decoded, err := inflatePDFStream(data)
+			if err != nil {
+				continue
+			}
+			data = decoded
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// Other filters are used for images and fonts, not text.
+			continue
+		}
+		if !bytes.Contains(data, []byte("BT")) {
+			continue
+		}
+		text.WriteString(pdfContentText(data))
+		if text.Len() > maxFileChars && utf8.RuneCountInString(text.String()) > maxFileChars {
+			// The rest would be cut off anyway.
+			break
+		}
+	}
+	extracted := strings.TrimSpace(text.String())
+	if extracted == "" {
+		return "", errors.New("no text could be found in the pdf")
+	}
+	return extracted, nil
+}
+
+func inflatePDFStream(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// Streams are often followed by padding, so a truncated stream is fine as long as some of it decoded.
+	decoded, err := io.ReadAll(io.LimitReader(r, maxPDFStreamBytes))
+	if len(decoded) == 0 && err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// pdfContentText extracts the text drawn by a content stream.
+func pdfContentText(data []byte) string {
+	var text strings.Builder
+	newline := func() {
+		current := text.String()
+		if current != "" && !strings.HasSuffix(current, "\n") {
+			text.WriteString("\n")
+		}
+	}
+	var operands []any
+	// The positions in operands where each array that is currently being parsed starts.
+	var arrayStarts []int
+	inText := false
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case isPDFWhitespace(c):
+			i++
+		case c == '%':
+			for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, n := parsePDFLiteralString(data[i:])
+			operands = append(operands, s)
+			i += n
+		case c == '<' && i+1 < len(data) && data[i+1] != '<':
+			s, n := parsePDFHexString(data[i:])
+			operands = append(operands, s)
+			i += n
+		case c == '[':
+			arrayStarts = append(arrayStarts, len(operands))
+			i++
+		case c == ']':
+			if len(arrayStarts) > 0 {
+				start := arrayStarts[len(arrayStarts)-1]
+				arrayStarts = arrayStarts[:len(arrayStarts)-1]
+				arr := slices.Clone(operands[start:])
+				operands = append(operands[:start], arr)
+			}
+			i++
+		default:
+			j := i
+			for j < len(data) && !isPDFWhitespace(data[j]) && !isPDFDelimiter(data[j]) {
+				j++
+			}
+			if j == i {
+				// An unexpected delimiter, such as the "<<" of an inline dictionary.
+				i++
+				continue
+			}
+			token := string(data[i:j])
+			i = j
+			if n, err := strconv.ParseFloat(token, 64); err == nil {
+				operands = append(operands, n)
+				continue
+			}
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				newline()
+			case "Td", "TD", "T*", "Tm":
+				newline()
+			case "Tj", "'", "\"":
+				if token != "Tj" {
+					newline()
+				}
+				if inText && len(operands) > 0 {
+					if s, ok := operands[len(operands)-1].(string); ok {
+						text.WriteString(s)
+					}
+				}
+			case "TJ":
+				if inText && len(operands) > 0 {
+					if arr, ok := operands[len(operands)-1].([]any); ok {
+						for _, item := range arr {
+							switch item := item.(type) {
+							case string:
+								text.WriteString(item)
+							case float64:
+								if item < -pdfWordGap {
+									text.WriteString(" ")
+								}
+							}
+						}
+					}
+				}
+			}
+			operands = operands[:0]
+			arrayStarts = arrayStarts[:0]
+		}
+	}
+	return text.String()
+}
+
+func isPDFWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// parsePDFLiteralString parses a string such as "(Hello \(world\))", returning the string and the number of bytes it took up.
+func parsePDFLiteralString(data []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 0
+	for ; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfDocString(s), i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(data) {
+				break
+			}
+			switch e := data[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f', '\r', '\n':
+				// Line continuations and control characters are dropped.
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				j := i
+				for j < len(data) && j < i+3 && data[j] >= '0' && data[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(string(data[i:j]), 8, 8)
+				s = append(s, byte(n))
+				i = j - 1
+			default:
+				s = append(s, e)
+			}
+			continue
+		}
+		s = append(s, c)
+	}
+	return pdfDocString(s), i
+}
+
+// parsePDFHexString parses a string such as "<48656C6C6F>", returning the string and the number of bytes it took up.
+func parsePDFHexString(data []byte) (string, int) {
+	end := bytes.IndexByte(data, '>')
+	if end < 0 {
+		return "", len(data)
+	}
+	digits := make([]byte, 0, end)
+	for _, c := range data[1:end] {
+		if !isPDFWhitespace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		n, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return "", end + 1
+		}
+		s = append(s, byte(n))
+	}
+	return pdfDocString(s), end + 1
+}
+
+// pdfDocString decodes the bytes of a pdf string, which are either UTF-16 (with a byte order mark) or close enough to Latin-1.
+func pdfDocString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		units := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(s))
+	for i, b := range s {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
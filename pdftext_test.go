@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testPDF builds a minimal pdf containing a single content stream, compressing it if flate is set.
+func testPDF(t *testing.T, content string, flate bool) []byte {
+	t.Helper()
+	data := []byte(content)
+	dict := fmt.Sprintf("<< /Length %d >>", len(data))
+	if flate {
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		w.Write(data)
+		w.Close()
+		data = compressed.Bytes()
+		dict = fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(data))
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n%s\nstream\n", dict)
+	pdf.Write(data)
+	pdf.WriteString("\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		flate   bool
+		want    string
+	}{
+		{
+			name:    "literal string",
+			content: "BT /F1 12 Tf 72 712 Td (Hello world) Tj ET",
+			want:    "Hello world",
+		},
+		{
+			name:    "literal string with escapes",
+			content: `BT (A \(nested\) \\ string\101) Tj ET`,
+			want:    `A (nested) \ stringA`,
+		},
+		{
+			name:    "hex string",
+			content: "BT <48656C6C6F> Tj ET",
+			want:    "Hello",
+		},
+		{
+			name:    "utf-16 hex string",
+			content: "BT <FEFF00E9007400E9> Tj ET",
+			want:    "été",
+		},
+		{
+			name:    "tj array with word gaps",
+			content: "BT [(Hel) 20 (lo) -300 (world)] TJ ET",
+			want:    "Hello world",
+		},
+		{
+			name:    "separate lines",
+			content: "BT (first) Tj 0 -14 Td (second) Tj T* (third) Tj ET",
+			want:    "first\nsecond\nthird",
+		},
+		{
+			name:    "flate stream",
+			content: "BT (compressed text) Tj ET",
+			flate:   true,
+			want:    "compressed text",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := extractPDFText(testPDF(t, test.content, test.flate))
+			if err != nil {
+				t.Fatalf("extractPDFText() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("extractPDFText() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtractPDFTextErrors(t *testing.T) {
+	if _, err := extractPDFText([]byte("not a pdf")); err == nil {
+		t.Error("expected an error for content that is not a pdf")
+	}
+	if _, err := extractPDFText(testPDF(t, "0 0 m 10 10 l S", false)); err == nil {
+		t.Error("expected an error for a pdf without text")
+	}
+}
+
+// A small compressed stream that expands enormously must not be decoded in full.
+func TestInflatePDFStreamIsLimited(t *testing.T) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	chunk := make([]byte, 1<<20)
+	for range 64 {
+		w.Write(chunk)
+	}
+	w.Close()
+	decoded, err := inflatePDFStream(compressed.Bytes())
+	if err != nil {
+		t.Fatalf("inflatePDFStream() error = %v", err)
+	}
+	if len(decoded) > maxPDFStreamBytes {
+		t.Errorf("decoded %d bytes, more than the limit of %d", len(decoded), maxPDFStreamBytes)
+	}
+}
+
+// Extraction stops once there is more text than would be kept.
+func TestExtractPDFTextStopsAtLimit(t *testing.T) {
+	line := "BT (" + strings.Repeat("x", 1000) + ") Tj ET\n"
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	for range maxFileChars/1000 + 50 {
+		fmt.Fprintf(&pdf, "<< /Length %d >>\nstream\n%s\nendstream\n", len(line), line)
+	}
+	got, err := extractPDFText(pdf.Bytes())
+	if err != nil {
+		t.Fatalf("extractPDFText() error = %v", err)
+	}
+	if n := len(got); n > maxFileChars+2000 {
+		t.Errorf("extracted %d characters, want extraction to stop soon after %d", n, maxFileChars)
+	}
+}
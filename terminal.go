@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func NewTerminalFrontend(in io.Reader, out io.Writer, authorName string, location string) *TerminalFrontend {
+	return &TerminalFrontend{
+		in:         in,
+		out:        out,
+		authorName: authorName,
+		location:   location,
+	}
+}
+
+// TerminalFrontend chats with the agent over a reader and writer (usually stdin and stdout), pretending to be a single author in a single location.
+type TerminalFrontend struct {
+	in         io.Reader
+	out        io.Writer
+	authorName string
+	location   string
+}
+
+func (t *TerminalFrontend) Run(handler MessageHandler) error {
+	scanner := bufio.NewScanner(t.in)
+	sink := &terminalReplySink{out: t.out}
+	for {
+		fmt.Fprint(t.out, t.authorName+"> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(t.out)
+			return scanner.Err()
+		}
+		content := strings.TrimSpace(scanner.Text())
+		if content == "" {
+			continue
+		}
+		handler.HandleMessage(IncomingMessage{
+			Author: Author{
+				ID:   "terminal:" + t.authorName,
+				Name: t.authorName,
+			},
+			Conversation: Conversation{
+				ID:       "terminal",
+				Location: t.location,
+				Private:  true,
+			},
+			Content: content,
+		}, sink)
+	}
+}
+
+type terminalReplySink struct {
+	out io.Writer
+}
+
+func (r *terminalReplySink) Reply(content string) error {
+	_, err := fmt.Fprintf(r.out, "craig> %s\n", content)
+	return err
+}
+
+func (r *terminalReplySink) ShowStatus(status string) {
+	fmt.Fprintf(r.out, "craig is %s...\n", status)
+}
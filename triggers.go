@@ -0,0 +1,137 @@
+package main
+
+import (
+	"craig/ai"
+	"craig/data"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+func newTriggerPolicy(policy data.TriggerPolicy, filter *ai.ReplyFilter) (*triggerPolicy, error) {
+	defaultRule, err := compileTriggerRule(policy.Default)
+	if err != nil {
+		return nil, err
+	}
+	channels := make(map[string]*triggerRule, len(policy.Channels))
+	for id, rule := range policy.Channels {
+		channels[id], err = compileTriggerRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trigger rule for channel %s: %w", id, err)
+		}
+	}
+	return &triggerPolicy{
+		defaultRule: defaultRule,
+		channels:    channels,
+		filter:      filter,
+		lastReplies: make(map[string]time.Time),
+	}, nil
+}
+
+// triggerPolicy decides which messages the agent is run for, so that the agent is not run for messages it would ignore anyway.
+type triggerPolicy struct {
+	defaultRule *triggerRule
+	channels    map[string]*triggerRule
+	filter      *ai.ReplyFilter
+	lock        sync.Mutex
+	lastReplies map[string]time.Time
+}
+
+type triggerRule struct {
+	data.TriggerRule
+	keywords []*regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+func compileTriggerRule(rule data.TriggerRule) (*triggerRule, error) {
+	compiled := &triggerRule{TriggerRule: rule}
+	for _, keyword := range rule.Keywords {
+		compiled.keywords = append(compiled.keywords, keywordPattern(keyword))
+	}
+	for _, pattern := range rule.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled.patterns = append(compiled.patterns, re)
+	}
+	return compiled, nil
+}
+
+// ShouldRun decides whether the agent should be run for a message, and why.
+func (p *triggerPolicy) ShouldRun(msg IncomingMessage) (bool, string, error) {
+	if msg.Conversation.Private {
+		return true, "private conversation", nil
+	}
+	if msg.Conversation.StartedByAgent {
+		return true, "conversation started by agent", nil
+	}
+	rule, ok := p.channels[msg.Conversation.ID]
+	if !ok {
+		rule, ok = p.channels[msg.Conversation.ParentID]
+	}
+	if !ok {
+		rule = p.defaultRule
+	}
+	if rule.OnMention && msg.MentionsAgent {
+		return true, "mentioned", nil
+	}
+	if rule.OnReply && msg.RepliesToAgent {
+		return true, "replied to", nil
+	}
+	for _, re := range rule.keywords {
+		if re.MatchString(msg.Content) {
+			return true, "keyword", nil
+		}
+	}
+	for _, re := range rule.patterns {
+		if re.MatchString(msg.Content) {
+			return true, "pattern", nil
+		}
+	}
+
+	// Anything past here is not clearly meant for the agent.
+	reason := ""
+	if rule.Always {
+		reason = "always"
+	} else if p.inActiveConversation(msg.Conversation.ID, rule) {
+		reason = "active conversation"
+	} else {
+		return false, "no trigger", nil
+	}
+	if !rule.FilterCheck {
+		return true, reason, nil
+	}
+	shouldReply, err := p.filter.ShouldReply(agentMessage(loadDetails(msg)))
+	if err != nil {
+		return false, "", err
+	}
+	if !shouldReply {
+		return false, "filtered out", nil
+	}
+	return true, reason + " (passed filter)", nil
+}
+
+// keywordPattern matches a keyword as a whole word (or words), ignoring case, so that "craig" does not match "craigslist".
+func keywordPattern(keyword string) *regexp.Regexp {
+	const boundary = `[^\p{L}\p{N}_]`
+	return regexp.MustCompile(`(?i)(?:^|` + boundary + `)` + regexp.QuoteMeta(keyword) + `(?:$|` + boundary + `)`)
+}
+
+func (p *triggerPolicy) inActiveConversation(conversationID string, rule *triggerRule) bool {
+	if rule.ActiveWindowMinutes <= 0 {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	lastReply, ok := p.lastReplies[conversationID]
+	return ok && time.Since(lastReply) < time.Duration(rule.ActiveWindowMinutes)*time.Minute
+}
+
+// Replied records that the agent has replied in a conversation, which starts its active conversation window.
+func (p *triggerPolicy) Replied(conversationID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastReplies[conversationID] = time.Now()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"craig/data"
+	"testing"
+)
+
+func TestTriggerKeywordsMatchWholeWords(t *testing.T) {
+	policy, err := newTriggerPolicy(data.TriggerPolicy{
+		Default: data.TriggerRule{Keywords: []string{"craig", "c++"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		content string
+		want    bool
+	}{
+		{"craig", true},
+		{"Hey Craig, what time is it?", true},
+		{"ask CRAIG.", true},
+		{"(craig)", true},
+		{"I found it on craigslist", false},
+		{"mcraig said so", false},
+		{"craig_bot is down", false},
+		{"help with C++ please", true},
+		{"C++20 is out", false},
+	}
+	for _, c := range cases {
+		got, _, err := policy.ShouldRun(IncomingMessage{Content: c.content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("ShouldRun(%q) = %v, want %v", c.content, got, c.want)
+		}
+	}
+}